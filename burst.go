@@ -0,0 +1,91 @@
+package main
+
+import (
+	"time"
+
+	"github.com/howardjohn/log-helper/pkg/color"
+)
+
+const (
+	// burstBaselineWindows is how many windows make up the rolling baseline.
+	burstBaselineWindows = 30
+	// burstMinLines is the fewest lines in a window that may count as a burst.
+	burstMinLines = 5
+)
+
+// BurstDetector tracks the rate of lines per matcher, and marks lines that occur while the rate is well above
+// its rolling baseline.
+type BurstDetector struct {
+	matchers []*Matcher
+	window   time.Duration
+	factor   float64
+	series   []*burstSeries
+	first    time.Time
+}
+
+type burstSeries struct {
+	color color.Color
+	// recent and baseline hold the times of lines within the window and baseline respectively
+	recent   []time.Time
+	baseline []time.Time
+}
+
+// NewBurstDetector builds a BurstDetector. With no matchers, the rate of all lines is tracked.
+func NewBurstDetector(matchers []*Matcher, window time.Duration, factor float64) *BurstDetector {
+	b := &BurstDetector{matchers: matchers, window: window, factor: factor}
+	for _, m := range matchers {
+		b.series = append(b.series, &burstSeries{color: m.color})
+	}
+	if len(matchers) == 0 {
+		b.series = append(b.series, &burstSeries{color: color.Red})
+	}
+	return b
+}
+
+// Observe records a line, and returns a gutter marking whether it is part of a burst.
+func (b *BurstDetector) Observe(line string, p *ParsedTime) string {
+	if p == nil {
+		return "  "
+	}
+	if b.first.IsZero() {
+		b.first = p.t
+	}
+	// Don't report anything until we have a full baseline
+	warm := p.t.Sub(b.first) >= b.window*burstBaselineWindows
+	var burst *burstSeries
+	for i, s := range b.series {
+		if len(b.matchers) > 0 && !b.matchers[i].r.MatchString(line) {
+			continue
+		}
+		s.observe(p.t, b.window)
+		if burst == nil && warm && s.bursting(b.factor) {
+			burst = s
+		}
+	}
+	if burst == nil {
+		return "  "
+	}
+	if flagValues.colorMode == "off" {
+		return "! "
+	}
+	return burst.color.Sprint("▌") + " "
+}
+
+func (s *burstSeries) observe(t time.Time, window time.Duration) {
+	s.recent = append(pruneBefore(s.recent, t.Add(-window)), t)
+	s.baseline = append(pruneBefore(s.baseline, t.Add(-window*burstBaselineWindows)), t)
+}
+
+func (s *burstSeries) bursting(factor float64) bool {
+	rate := float64(len(s.recent))
+	baseline := float64(len(s.baseline)) / burstBaselineWindows
+	return len(s.recent) >= burstMinLines && rate > factor*baseline
+}
+
+func pruneBefore(times []time.Time, cutoff time.Time) []time.Time {
+	i := 0
+	for i < len(times) && times[i].Before(cutoff) {
+		i++
+	}
+	return times[i:]
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/howardjohn/log-helper/pkg/color"
+)
+
+func TestBurstDetector(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	type event struct {
+		line string
+		time time.Time
+	}
+	// One line a second for the baseline, then a burst of lines in a single second
+	events := []event{}
+	for i := 0; i < 40; i++ {
+		events = append(events, event{"info steady", start.Add(time.Duration(i) * time.Second)})
+	}
+	for i := 0; i < 6; i++ {
+		events = append(events, event{"info burst", start.Add(40*time.Second + time.Duration(i)*100*time.Millisecond)})
+	}
+	events = append(events, event{"no timestamp", time.Time{}})
+	tests := []struct {
+		name     string
+		matchers []*Matcher
+		want     int
+	}{
+		{"all lines", nil, 2},
+		{"matched", []*Matcher{NewMatcher(regexp.MustCompile("burst|steady"), color.Red)}, 2},
+		{"unmatched", []*Matcher{NewMatcher(regexp.MustCompile("error"), color.Red)}, 0},
+	}
+	defer func(mode string) { flagValues.colorMode = mode }(flagValues.colorMode)
+	flagValues.colorMode = "off"
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := NewBurstDetector(tt.matchers, time.Second, 3)
+			got := 0
+			for i, e := range events {
+				var p *ParsedTime
+				if !e.time.IsZero() {
+					p = &ParsedTime{t: e.time}
+				}
+				gutter := b.Observe(e.line, p)
+				if gutter == "! " {
+					got++
+					if i < 40 {
+						t.Errorf("line %d unexpectedly marked as a burst", i)
+					}
+				} else if gutter != "  " {
+					t.Errorf("unexpected gutter %q", gutter)
+				}
+			}
+			if got != tt.want {
+				t.Errorf("got %d burst lines, want %d", got, tt.want)
+			}
+		})
+	}
+}
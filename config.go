@@ -6,23 +6,66 @@ import (
 	"os"
 	"path/filepath"
 	"regexp"
+	"sort"
 	"strings"
 
 	"github.com/howardjohn/log-helper/pkg/color"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/util/jsonpath"
 	"sigs.k8s.io/yaml"
 )
 
 type ConfigFile struct {
 	Presets map[string]Config `json:"presets"`
+	// LnavFormats are lnav format files, or directories of them. Relative paths are relative to the config file.
+	// Each format adds its timestamps to the known formats, and a preset (named after the format) highlighting its levels.
+	LnavFormats []string `json:"lnavFormats"`
+	// KubeResources are additional resources, such as custom resources, to resolve addresses from with -k.
+	KubeResources []ConfigKubeResource `json:"kubeResources"`
 }
 
 type ConfigMatcher struct {
 	Regex string `json:"regex"`
 }
 
+type ConfigTimeGradient struct {
+	// Colors are the gradient stops, from the fastest lines to the slowest
+	Colors []string `json:"colors"`
+	// Scale is how deltas are placed on the gradient: rank, linear, or log
+	Scale TimeScale `json:"scale"`
+}
+
+type ConfigLatency struct {
+	// Name is shown alongside the latency, to distinguish multiple pairs
+	Name string `json:"name"`
+	// Start and End match the events to measure between. They are correlated by the `id` capture group,
+	// or the first capture group if there is no `id`.
+	Start string `json:"start"`
+	End   string `json:"end"`
+}
+
+type ConfigKubeResource struct {
+	Group    string `json:"group"`
+	Version  string `json:"version"`
+	Resource string `json:"resource"`
+	// Kind is the kind of the resource, such as WorkloadEntry. It is used in names and to find objects in snapshots.
+	Kind string `json:"kind"`
+	// Address is a JSONPath expression for the addresses of an object, for example {.spec.endpoints[*].address}
+	Address string `json:"address"`
+	// Name is a JSONPath expression for the name addresses are replaced with. Defaults to the object's name.
+	Name string `json:"name"`
+}
+
 type Config struct {
-	Colors   []string        `json:"colors"`
-	Matchers []ConfigMatcher `json:"matchers"`
+	Colors       []string           `json:"colors"`
+	Matchers     []ConfigMatcher    `json:"matchers"`
+	TimeGradient ConfigTimeGradient `json:"timeGradient"`
+	Latencies    []ConfigLatency    `json:"latencies"`
+
+	// LogFormats are additional timestamp formats, from LnavFormats
+	LogFormats []LogFormat `json:"-"`
+	// KubeResources are from the config file's KubeResources
+	KubeResources []ConfigKubeResource `json:"-"`
 }
 
 type Matcher struct {
@@ -32,6 +75,14 @@ type Matcher struct {
 	color    color.Color
 }
 
+func NewMatcher(r *regexp.Regexp, c color.Color) *Matcher {
+	return &Matcher{
+		r:        r,
+		variants: map[string]int{},
+		color:    c,
+	}
+}
+
 func (c Config) GetMatchers(extra []string) []*Matcher {
 	matchers := c.Matchers
 	for _, m := range extra {
@@ -40,16 +91,65 @@ func (c Config) GetMatchers(extra []string) []*Matcher {
 	colors := ParseColors(c.Colors)
 	resp := []*Matcher{}
 	for i, r := range matchers {
-		rx := compileRegex(r.Regex)
-		resp = append(resp, &Matcher{
-			r:        rx,
-			variants: map[string]int{},
-			color:    ExtrapolateColorList(colors, i, len(matchers)),
-		})
+		resp = append(resp, NewMatcher(compileRegex(r.Regex), ExtrapolateColorList(colors, i, len(matchers))))
 	}
 	return resp
 }
 
+func (c Config) GetTimeGradient() (color.Gradiant, TimeScale, error) {
+	colors := c.TimeGradient.Colors
+	if len(colors) == 0 {
+		colors = []string{`#00ff00`, `#ffff00`, `#ff0000`}
+	}
+	scale := c.TimeGradient.Scale
+	switch scale {
+	case "":
+		scale = RankScale
+	case RankScale, LinearScale, LogScale:
+	default:
+		return color.Gradiant{}, "", fmt.Errorf("unknown time scale %q, expected rank, linear, or log", scale)
+	}
+	return color.NewGradiant(ParseColors(colors)...), scale, nil
+}
+
+func (c Config) GetLatencyPairs() []LatencyPair {
+	res := make([]LatencyPair, 0, len(c.Latencies))
+	for _, l := range c.Latencies {
+		res = append(res, LatencyPair{
+			name:  l.Name,
+			start: compileRegex(l.Start),
+			end:   compileRegex(l.End),
+		})
+	}
+	return res
+}
+
+func (c Config) GetKubeResources() ([]dynamicKind, error) {
+	res := make([]dynamicKind, 0, len(c.KubeResources))
+	for _, r := range c.KubeResources {
+		address, err := parseJSONPath(r.Address)
+		if err != nil {
+			return nil, fmt.Errorf("kube resource %v: address: %v", r.Resource, err)
+		}
+		var name *jsonpath.JSONPath
+		if r.Name != "" {
+			name, err = parseJSONPath(r.Name)
+			if err != nil {
+				return nil, fmt.Errorf("kube resource %v: name: %v", r.Resource, err)
+			}
+		}
+		if r.Kind == "" {
+			return nil, fmt.Errorf("kube resource %v: kind is required", r.Resource)
+		}
+		res = append(res, dynamicKind{
+			resource: schema.GroupVersionResource{Group: r.Group, Version: r.Version, Resource: r.Resource},
+			kind:     r.Kind,
+			extract:  extractJSONPath(r.Kind, address, name),
+		})
+	}
+	return res, nil
+}
+
 func ExtrapolateColorList(colors []color.Color, idx int, max int) color.Color {
 	tints := max/len(colors) + 1
 	tint := idx / len(colors)
@@ -90,16 +190,57 @@ func ReadConfig(preset string) (Config, error) {
 	if err := yaml.Unmarshal(by, &c); err != nil {
 		return Config{}, err
 	}
+	formats, err := loadLnavFormats(resolvePaths(filepath.Join(base, "log-helper"), c.LnavFormats))
+	if err != nil {
+		return Config{}, err
+	}
+	names := make([]string, 0, len(formats))
+	for name := range formats {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	logFormats := []LogFormat{}
+	for _, name := range names {
+		lf := formats[name]
+		logFormats = append(logFormats, lf.LogFormats()...)
+		if _, f := c.Presets[name]; !f {
+			if c.Presets == nil {
+				c.Presets = map[string]Config{}
+			}
+			c.Presets[name] = lf.Preset(name, defaultConfig.Colors)
+		}
+	}
 	cfg, f := c.Presets[preset]
 	if !f {
-		if preset == "default" {
-			return defaultConfig, nil
+		if preset != "default" {
+			return Config{}, fmt.Errorf("preset %q not defined", preset)
 		}
-		return Config{}, fmt.Errorf("preset %q not defined", preset)
+		cfg = defaultConfig
 	}
+	if len(cfg.Colors) == 0 {
+		cfg.Colors = defaultConfig.Colors
+	}
+	cfg.LogFormats = logFormats
+	cfg.KubeResources = c.KubeResources
 	return cfg, nil
 }
 
+func resolvePaths(base string, paths []string) []string {
+	res := make([]string, 0, len(paths))
+	for _, p := range paths {
+		if strings.HasPrefix(p, "~/") {
+			if home, err := os.UserHomeDir(); err == nil {
+				p = filepath.Join(home, p[2:])
+			}
+		}
+		if !filepath.IsAbs(p) {
+			p = filepath.Join(base, p)
+		}
+		res = append(res, p)
+	}
+	return res
+}
+
 func compileRegex(regex string) *regexp.Regexp {
 	if strings.HasSuffix(regex, "\\x") {
 		base := strings.TrimSuffix(regex, "\\x")
@@ -7,6 +7,27 @@ import (
 	"github.com/howardjohn/log-helper/pkg/color"
 )
 
+type Highlighter struct {
+	replacer Replacer
+	matchers MatcherProvider
+}
+
+func (h Highlighter) Highlight(line string) string {
+	return h.HighlightAt(line, nil)
+}
+
+// HighlightAt highlights a line, resolving replacements as of the time of the line, if known.
+func (h Highlighter) HighlightAt(line string, p *ParsedTime) string {
+	var r string
+	if tr, ok := h.replacer.(TimedReplacer); ok && p != nil {
+		r = tr.ReplaceAt(line, p.t)
+	} else {
+		r = h.replacer.Replace(line)
+	}
+	m := FindAllMatches(h.matchers.GetMatchers(), r)
+	return getLine(m, r)
+}
+
 func FindAllMatches(ms []*Matcher, s string) []ColoredIndexRange {
 	current := []ColoredIndexRange{}
 	for _, m := range ms {
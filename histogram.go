@@ -0,0 +1,203 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/howardjohn/log-helper/pkg/color"
+)
+
+const histogramWidth = 60
+
+// maxHistogramBuckets bounds the rows a histogram may have, as a small bucket over a long log would otherwise
+// allocate millions of them.
+const maxHistogramBuckets = 10000
+
+// histogramBucket is a flag for the bucket size, which must be positive if set.
+type histogramBucket time.Duration
+
+func (b *histogramBucket) String() string {
+	return time.Duration(*b).String()
+}
+
+func (b *histogramBucket) Set(v string) error {
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		return err
+	}
+	if d <= 0 {
+		return fmt.Errorf("bucket must be positive, got %v", d)
+	}
+	*b = histogramBucket(d)
+	return nil
+}
+
+// niceBuckets are the bucket sizes we pick from when auto-sizing a histogram.
+var niceBuckets = []time.Duration{
+	time.Millisecond, 5 * time.Millisecond, 10 * time.Millisecond, 50 * time.Millisecond, 100 * time.Millisecond,
+	500 * time.Millisecond, time.Second, 5 * time.Second, 10 * time.Second, 30 * time.Second,
+	time.Minute, 5 * time.Minute, 10 * time.Minute, 30 * time.Minute,
+	time.Hour, 6 * time.Hour, 12 * time.Hour, 24 * time.Hour,
+}
+
+var sparks = []rune("▁▂▃▄▅▆▇█")
+
+type HistogramSeries struct {
+	name  string
+	color color.Color
+}
+
+// Histogram counts the number of lines in each time interval, optionally split by which matcher the line matched.
+type Histogram struct {
+	start  time.Time
+	end    time.Time
+	bucket time.Duration
+	series []HistogramSeries
+	// counts is indexed by bucket, then series
+	counts [][]int
+}
+
+// NewHistogram buckets records by time. If bucket is 0, a size is picked to give roughly target buckets.
+// When matchers are given, each line is counted under the first matcher it matches, or "other".
+// An error is returned if the bucket would give more than maxHistogramBuckets buckets.
+func NewHistogram(records []LogRecord, matchers []*Matcher, bucket time.Duration, target int) (*Histogram, error) {
+	h := &Histogram{}
+	for _, r := range records {
+		if r.time == nil {
+			continue
+		}
+		if h.start.IsZero() || r.time.t.Before(h.start) {
+			h.start = r.time.t
+		}
+		if r.time.t.After(h.end) {
+			h.end = r.time.t
+		}
+	}
+	if bucket == 0 {
+		bucket = autoBucket(h.end.Sub(h.start), target)
+	}
+	h.bucket = bucket
+	h.start = h.start.Truncate(bucket)
+	buckets := h.end.Sub(h.start)/bucket + 1
+	if buckets > maxHistogramBuckets {
+		return nil, fmt.Errorf("bucket %v gives %d buckets over %v, more than the maximum of %d", bucket, buckets, h.end.Sub(h.start), maxHistogramBuckets)
+	}
+	h.counts = make([][]int, buckets)
+
+	if len(matchers) == 0 {
+		h.series = []HistogramSeries{{name: "lines"}}
+	} else {
+		for _, m := range matchers {
+			h.series = append(h.series, HistogramSeries{name: m.r.String(), color: m.color})
+		}
+		h.series = append(h.series, HistogramSeries{name: "other"})
+	}
+	for i := range h.counts {
+		h.counts[i] = make([]int, len(h.series))
+	}
+	for _, r := range records {
+		if r.time == nil {
+			continue
+		}
+		b := int(r.time.t.Sub(h.start) / bucket)
+		h.counts[b][seriesFor(r, matchers)]++
+	}
+	return h, nil
+}
+
+func autoBucket(span time.Duration, target int) time.Duration {
+	for _, b := range niceBuckets {
+		if span/b < time.Duration(target) {
+			return b
+		}
+	}
+	return niceBuckets[len(niceBuckets)-1]
+}
+
+func seriesFor(r LogRecord, matchers []*Matcher) int {
+	for i, m := range matchers {
+		for _, l := range r.lines {
+			if m.r.MatchString(l) {
+				return i
+			}
+		}
+	}
+	return len(matchers)
+}
+
+func (h *Histogram) label(t time.Time, loc *time.Location) string {
+	if h.end.Sub(h.start) >= 24*time.Hour {
+		return t.In(loc).Format("01-02 15:04:05")
+	}
+	return t.In(loc).Format("15:04:05.000")
+}
+
+func colorize(c color.Color, s string) string {
+	if c == nil || flagValues.colorMode == "off" {
+		return s
+	}
+	return c.Sprint(s)
+}
+
+// WriteBars renders one row per bucket, with a bar stacked by series.
+func (h *Histogram) WriteBars(w io.Writer, loc *time.Location) {
+	most := 0
+	for _, c := range h.counts {
+		most = max(most, sum(c))
+	}
+	fmt.Fprintf(w, "bucket: %v, max: %d lines\n", h.bucket, most)
+	for i, c := range h.counts {
+		sb := strings.Builder{}
+		for s, n := range c {
+			sb.WriteString(colorize(h.series[s].color, strings.Repeat("█", scale(n, most, histogramWidth))))
+		}
+		fmt.Fprintf(w, "%s %6d %s\n", h.label(h.start.Add(time.Duration(i)*h.bucket), loc), sum(c), sb.String())
+	}
+	if len(h.series) > 1 {
+		for _, s := range h.series {
+			fmt.Fprintf(w, "%s %s\n", colorize(s.color, "█"), s.name)
+		}
+	}
+}
+
+// WriteSparklines renders a single line per series, each scaled to its own maximum.
+func (h *Histogram) WriteSparklines(w io.Writer, loc *time.Location) {
+	width := 0
+	for _, s := range h.series {
+		width = max(width, len(s.name))
+	}
+	fmt.Fprintf(w, "%s - %s, bucket: %v\n", h.label(h.start, loc), h.label(h.start.Add(time.Duration(len(h.counts))*h.bucket), loc), h.bucket)
+	for s, series := range h.series {
+		most := 0
+		for _, c := range h.counts {
+			most = max(most, c[s])
+		}
+		sb := strings.Builder{}
+		for _, c := range h.counts {
+			if c[s] == 0 {
+				sb.WriteRune(' ')
+				continue
+			}
+			sb.WriteRune(sparks[scale(c[s], most, len(sparks))-1])
+		}
+		fmt.Fprintf(w, "%-*s %6d %s\n", width, series.name, most, colorize(series.color, sb.String()))
+	}
+}
+
+// scale maps n in [0,total] to [0,size], ensuring any non-zero n is at least 1.
+func scale(n, total, size int) int {
+	if n == 0 || total == 0 {
+		return 0
+	}
+	return max(1, n*size/total)
+}
+
+func sum(ns []int) int {
+	t := 0
+	for _, n := range ns {
+		t += n
+	}
+	return t
+}
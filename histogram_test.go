@@ -0,0 +1,27 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNewHistogram(t *testing.T) {
+	records, err := readRecords(0, strings.NewReader(
+		"2024-01-01T00:00:00.000000Z a\n2024-01-01T00:00:00.500000Z b\n2024-01-01T00:00:02.000000Z c\n",
+	), NewTimeMatcher(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, err := NewHistogram(records, nil, time.Second, histogramWidth)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := [][]int{{2}, {0}, {1}}; !reflect.DeepEqual(h.counts, want) {
+		t.Errorf("counts = %v, want %v", h.counts, want)
+	}
+	if _, err := NewHistogram(records, nil, time.Nanosecond, histogramWidth); err == nil {
+		t.Error("expected an error for too many buckets")
+	}
+}
@@ -1,22 +1,34 @@
 package main
 
 import (
+	"context"
+	"fmt"
+	"io"
 	"os"
-	"path/filepath"
 	"regexp"
 	"sort"
 	"strings"
 	"sync"
+	"text/template"
+	"time"
 
 	"github.com/howardjohn/log-helper/pkg/color"
+	authorizationv1 "k8s.io/api/authorization/v1"
 	v1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/discovery"
 	"k8s.io/client-go/informers"
 	"k8s.io/client-go/kubernetes"
 	_ "k8s.io/client-go/plugin/pkg/client/auth"
+	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/cache"
 	"k8s.io/client-go/tools/clientcmd"
-	"k8s.io/client-go/util/homedir"
 )
 
 type Replacer interface {
@@ -25,75 +37,419 @@ type Replacer interface {
 
 type KubeReplacer struct {
 	*strings.Replacer
-	mu           sync.RWMutex
+	mu sync.RWMutex
+	// objects holds the object each address (or name) belongs to
+	objects map[string]KubeObject
+	// replacements holds the rendered name for each address
 	replacements map[string]string
-	translateIPs bool
+	// owners holds the owner (see objectOwner) of each address, and owned the addresses of each owner
+	owners map[string]string
+	owned  map[string]map[string]struct{}
+	// claimants holds every owner currently reporting each address, and the object it reports. An address shared by
+	// several objects, such as an Ingress and the Service of its controller, falls back to another claimant when its
+	// owner is removed.
+	claimants map[string]map[string]KubeObject
+	// levels holds how each object's default name is qualified, when there is no template
+	levels map[KubeObject]nameQualifier
+	// history holds the periods of time each address was owned by each object
+	history map[string][]ownership
+	// marker wraps every address in history with markers, so ReplaceAt can find them
+	marker *strings.Replacer
+	// historicNames holds the names of all objects in history, and their cluster
+	historicNames map[string]string
+	// historyKeysChanged is set when addresses are added to or removed from history, so marker must be rebuilt
+	historyKeysChanged bool
+	// historyRetention, if set, is how long ownerships are kept in history once they end
+	historyRetention time.Duration
+	// deferRebuilds batches rebuilds after changes (see changed). dirty is set while a rebuild is needed, and
+	// flushPending while one is scheduled.
+	deferRebuilds bool
+	dirty         bool
+	flushPending  bool
+	translateIPs  bool
+	markDeleted   bool
+	clusterPrefix bool
+	template      *template.Template
+	// dynamicKinds are the built in dynamicKinds and the Resources of the options
+	dynamicKinds []dynamicKind
+	// namespace and selector scope objects loaded from a snapshot; informers are scoped by the API server
+	namespace string
+	selector  labels.Selector
+	// synced is closed once all objects have been loaded, or the sync timeout has passed
+	synced   chan struct{}
+	syncOnce sync.Once
+}
+
+// KubeObject is the object an address belongs to. It is the data passed to the name template.
+type KubeObject struct {
+	// Cluster is the name of the cluster the object is in, when watching named or multiple contexts
+	Cluster   string
+	Kind      string
+	Name      string
+	Namespace string
+	// Deleted is set for addresses whose owner has been deleted, and have not been reused yet
+	Deleted bool
+	// highlightOnly marks names which should be highlighted, but not replaced
+	highlightOnly bool
 }
 
 var _ Replacer = &KubeReplacer{}
 
-func NewKubeReplacer(translateIPs bool) (*KubeReplacer, error) {
-	cfg := filepath.Join(homedir.HomeDir(), ".kube", "config")
-	if c := os.Getenv("KUBECONFIG"); c != "" {
-		cfg = c
-	}
-	config, err := clientcmd.BuildConfigFromFlags("", cfg)
+// KubeOptions configures a KubeReplacer.
+type KubeOptions struct {
+	// TranslateIPs replaces addresses with names, rather than only highlighting names
+	TranslateIPs bool
+	// NameTemplate, if set, is used to render each object's name (for example `{{.Name}}.{{.Namespace}}`).
+	// Otherwise names are only qualified when they would collide.
+	NameTemplate string
+	// MarkDeleted keeps addresses of deleted objects, marked as deleted, until they are reused.
+	MarkDeleted bool
+	// Snapshot, if set, is a file or directory of objects to read instead of watching a live cluster.
+	Snapshot string
+	// Kubeconfig overrides the kubeconfig file, otherwise KUBECONFIG or ~/.kube/config.
+	Kubeconfig string
+	// Contexts are the kubeconfig contexts to watch, each a cluster, otherwise the current context. A context may
+	// be given a shorter cluster name as name=context.
+	Contexts []string
+	// ClusterPrefix prefixes names with their cluster, as cluster/name.
+	ClusterPrefix bool
+	// Namespace and Selector, if set, limit objects to a namespace and a label selector.
+	Namespace string
+	Selector  string
+	// SyncTimeout, if set, is how long WaitForSync waits for the cluster, after which syncing continues in the
+	// background. If unset, WaitForSync waits until the cluster has synced.
+	SyncTimeout time.Duration
+	// Resources are additional kinds to resolve, such as custom resources.
+	Resources []dynamicKind
+	// Cache, if set, is a table (see WriteTable) to start from while informers sync in the background. It is
+	// rewritten once they have synced.
+	Cache string
+}
+
+// kubeKinds are the kinds addresses are extracted from, both from informers and snapshots.
+var kubeKinds = []struct {
+	object   runtime.Object
+	resource schema.GroupVersionResource
+	// namespaced is false for cluster scoped kinds
+	namespaced bool
+	informer   func(f informers.SharedInformerFactory) cache.SharedIndexInformer
+	extract    func(o runtime.Object) map[string]KubeObject
+}{
+	{&v1.Node{}, v1.SchemeGroupVersion.WithResource("nodes"), false, func(f informers.SharedInformerFactory) cache.SharedIndexInformer {
+		return f.Core().V1().Nodes().Informer()
+	}, extractNode},
+	{&v1.Service{}, v1.SchemeGroupVersion.WithResource("services"), true, func(f informers.SharedInformerFactory) cache.SharedIndexInformer {
+		return f.Core().V1().Services().Informer()
+	}, extractService},
+	{&v1.Pod{}, v1.SchemeGroupVersion.WithResource("pods"), true, func(f informers.SharedInformerFactory) cache.SharedIndexInformer {
+		return f.Core().V1().Pods().Informer()
+	}, extractPod},
+	{&discoveryv1.EndpointSlice{}, discoveryv1.SchemeGroupVersion.WithResource("endpointslices"), true, func(f informers.SharedInformerFactory) cache.SharedIndexInformer {
+		return f.Discovery().V1().EndpointSlices().Informer()
+	}, extractEndpointSlice},
+	{&networkingv1.Ingress{}, networkingv1.SchemeGroupVersion.WithResource("ingresses"), true, func(f informers.SharedInformerFactory) cache.SharedIndexInformer {
+		return f.Networking().V1().Ingresses().Informer()
+	}, extractIngress},
+}
+
+// NewKubeReplacer builds a KubeReplacer, either watching the cluster of a kubeconfig context or reading a snapshot.
+// A cluster is connected to in the background; until it has synced, addresses are not replaced (or are replaced
+// from the cache). If the cluster is unreachable, a warning is written and nothing is replaced.
+func NewKubeReplacer(opts KubeOptions) (*KubeReplacer, error) {
+	r, err := newKubeReplacer(opts)
 	if err != nil {
 		return nil, err
 	}
-	client, err := kubernetes.NewForConfig(config)
-	if err != nil {
-		return nil, err
+	r.deferRebuilds = true
+	if opts.Snapshot != "" {
+		if err := r.loadSnapshot(opts.Snapshot); err != nil {
+			return nil, err
+		}
+		r.flush()
+		r.markSynced()
+		return r, nil
 	}
-	r := &KubeReplacer{
-		replacements: map[string]string{},
-		Replacer:     strings.NewReplacer(),
-		translateIPs: translateIPs,
-	}
-	factory := informers.NewSharedInformerFactory(client, 0)
-	factory.Core().V1().Nodes().Informer().AddEventHandler(r.ObjectHandler(func(o runtime.Object) map[string]string {
-		n := o.(*v1.Node)
-		m := map[string]string{}
-		for _, a := range n.Status.Addresses {
-			if a.Type == v1.NodeInternalIP {
-				m[a.Address] = n.Name
-			}
+	r.historyRetention = historyRetention
+	if opts.Cache != "" {
+		if err := r.loadTable(opts.Cache); err != nil && !os.IsNotExist(err) {
+			// The cache is rewritten once synced, so a bad one only costs a slower start
+			kubeWarning("ignoring unreadable cache: %v", err)
 		}
-		return m
-	}))
-	factory.Core().V1().Services().Informer().AddEventHandler(r.ObjectHandler(func(o runtime.Object) map[string]string {
-		s := o.(*v1.Service)
-		m := map[string]string{}
-		for _, cip := range s.Spec.ClusterIPs {
-			if cip != "None" && cip != "" {
-				m[cip] = s.Name
-			}
+	}
+	contexts := opts.Contexts
+	if len(contexts) == 0 {
+		contexts = []string{""}
+	}
+	rules := clientcmd.NewDefaultClientConfigLoadingRules()
+	rules.ExplicitPath = opts.Kubeconfig
+	wg := sync.WaitGroup{}
+	for _, c := range contexts {
+		cluster, kubeContext := parseKubeContext(c)
+		overrides := &clientcmd.ConfigOverrides{CurrentContext: kubeContext}
+		config, err := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(rules, overrides).ClientConfig()
+		if err != nil {
+			kubeWarning("unable to load kubeconfig: %v", err)
+			continue
 		}
-		for _, a := range s.Status.LoadBalancer.Ingress {
-			m[a.IP] = s.Name + "-loadbalancer"
-		}
-		return m
-	}))
-	factory.Core().V1().Pods().Informer().AddEventHandler(r.ObjectHandler(func(o runtime.Object) map[string]string {
-		p := o.(*v1.Pod)
-		if p.Spec.HostNetwork {
-			// Node will find it. Just return a map of ourself so the pod name is highlighted
-			return map[string]string{
-				p.Name: p.Name,
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r.watch(cluster, config, opts)
+		}()
+	}
+	go func() {
+		wg.Wait()
+		if opts.Cache != "" {
+			if err := r.WriteTable(opts.Cache); err != nil {
+				kubeWarning("failed to write cache: %v", err)
 			}
 		}
-		m := map[string]string{}
-		for _, i := range p.Status.PodIPs {
-			m[i.IP]= p.Name
+		r.markSynced()
+	}()
+	r.syncWithin(opts.SyncTimeout)
+	return r, nil
+}
+
+// syncWithin marks the replacer synced once timeout has passed, if it hasn't synced by then, so WaitForSync stops
+// waiting while syncing continues in the background. A zero timeout waits forever.
+func (kr *KubeReplacer) syncWithin(timeout time.Duration) {
+	if timeout <= 0 {
+		return
+	}
+	go func() {
+		select {
+		case <-kr.synced:
+		case <-time.After(timeout):
+			kubeWarning("not synced after %v, continuing in the background", timeout)
+			kr.markSynced()
+		}
+	}()
+}
+
+// parseKubeContext splits a context given as name=context, or just context, into a cluster name and context.
+func parseKubeContext(s string) (cluster string, context string) {
+	if name, context, f := strings.Cut(s, "="); f {
+		return name, context
+	}
+	return s, s
+}
+
+// watch connects to a cluster and starts informers for kubeKinds, returning once they have synced. Cached
+// addresses of the cluster are then dropped, as the informers have claimed any that still exist.
+func (kr *KubeReplacer) watch(cluster string, config *rest.Config, opts KubeOptions) {
+	client, err := kubeClient(config, opts.SyncTimeout)
+	if err != nil {
+		if cluster != "" {
+			kubeWarning("unable to connect to cluster %v: %v", cluster, err)
+		} else {
+			kubeWarning("unable to connect to cluster: %v", err)
+		}
+		return
+	}
+	factory := informers.NewSharedInformerFactoryWithOptions(client, 0,
+		informers.WithNamespace(opts.Namespace),
+		informers.WithTweakListOptions(func(o *metav1.ListOptions) {
+			o.LabelSelector = opts.Selector
+		}))
+	for _, k := range kubeKinds {
+		if !canWatch(client, cluster, k.resource, k.namespaced, opts.Namespace) {
+			continue
 		}
-		return m
-	}))
+		k.informer(factory).AddEventHandler(kr.ObjectHandler(cluster, k.extract))
+	}
 	stop := make(chan struct{})
 	factory.Start(stop)
+	kr.watchDynamic(cluster, config, client, opts, stop)
 	factory.WaitForCacheSync(stop)
+	kr.flush()
+	if opts.Cache != "" {
+		kr.dropCached(cluster)
+	}
+}
+
+// kubeClient builds a client, first checking the cluster is reachable within timeout, as informers retry forever.
+func kubeClient(config *rest.Config, timeout time.Duration) (*kubernetes.Clientset, error) {
+	check := rest.CopyConfig(config)
+	check.Timeout = timeout
+	dc, err := discovery.NewDiscoveryClientForConfig(check)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := dc.ServerVersion(); err != nil {
+		return nil, err
+	}
+	return kubernetes.NewForConfig(config)
+}
+
+// canWatch returns whether we may list and watch a resource, warning if not, as informers for forbidden resources
+// never sync. If access can't be checked, the informer is left to try.
+func canWatch(client kubernetes.Interface, cluster string, gvr schema.GroupVersionResource, namespaced bool, namespace string) bool {
+	if !namespaced {
+		namespace = ""
+	}
+	for _, verb := range []string{"list", "watch"} {
+		review := &authorizationv1.SelfSubjectAccessReview{
+			Spec: authorizationv1.SelfSubjectAccessReviewSpec{
+				ResourceAttributes: &authorizationv1.ResourceAttributes{
+					Namespace: namespace,
+					Verb:      verb,
+					Group:     gvr.Group,
+					Version:   gvr.Version,
+					Resource:  gvr.Resource,
+				},
+			},
+		}
+		res, err := client.AuthorizationV1().SelfSubjectAccessReviews().Create(context.Background(), review, metav1.CreateOptions{})
+		if err != nil {
+			return true
+		}
+		if !res.Status.Allowed {
+			if cluster != "" {
+				kubeWarning("not permitted to %v %v in cluster %v, skipping", verb, gvr.GroupResource(), cluster)
+			} else {
+				kubeWarning("not permitted to %v %v, skipping", verb, gvr.GroupResource())
+			}
+			return false
+		}
+	}
+	return true
+}
+
+func kubeWarning(format string, args ...any) {
+	fmt.Fprintf(os.Stderr, "warning: Kubernetes: "+format+"\n", args...)
+}
+
+func (kr *KubeReplacer) markSynced() {
+	kr.syncOnce.Do(func() {
+		close(kr.synced)
+	})
+}
+
+// WaitForSync blocks until all objects have been loaded, or the sync timeout has passed.
+func (kr *KubeReplacer) WaitForSync() {
+	<-kr.synced
+}
+
+func newKubeReplacer(opts KubeOptions) (*KubeReplacer, error) {
+	r := &KubeReplacer{
+		objects:       map[string]KubeObject{},
+		replacements:  map[string]string{},
+		owners:        map[string]string{},
+		owned:         map[string]map[string]struct{}{},
+		claimants:     map[string]map[string]KubeObject{},
+		history:       map[string][]ownership{},
+		Replacer:      strings.NewReplacer(),
+		translateIPs:  opts.TranslateIPs,
+		markDeleted:   opts.MarkDeleted,
+		clusterPrefix: opts.ClusterPrefix,
+		dynamicKinds:  append(append([]dynamicKind{}, dynamicKinds...), opts.Resources...),
+		synced:        make(chan struct{}),
+		namespace:     opts.Namespace,
+	}
+	if opts.Selector != "" {
+		sel, err := labels.Parse(opts.Selector)
+		if err != nil {
+			return nil, err
+		}
+		r.selector = sel
+	}
+	if opts.NameTemplate != "" {
+		t, err := template.New("name").Parse(opts.NameTemplate)
+		if err != nil {
+			return nil, err
+		}
+		// Parse accepts unknown fields, such as {{.Nme}}, which only fail once executed
+		sample := KubeObject{Cluster: "cluster", Kind: "Pod", Name: "name", Namespace: "namespace"}
+		if err := t.Execute(io.Discard, sample); err != nil {
+			return nil, err
+		}
+		r.template = t
+	}
 	return r, nil
 }
 
+func extractNode(o runtime.Object) map[string]KubeObject {
+	n := o.(*v1.Node)
+	m := map[string]KubeObject{}
+	for _, a := range n.Status.Addresses {
+		switch a.Type {
+		case v1.NodeInternalIP:
+			m[a.Address] = KubeObject{Kind: "Node", Name: n.Name}
+		case v1.NodeExternalIP:
+			m[a.Address] = KubeObject{Kind: "Node", Name: n.Name + "-external"}
+		case v1.NodeHostName:
+			if a.Address != n.Name {
+				m[a.Address] = KubeObject{Kind: "Node", Name: n.Name + "-hostname"}
+			}
+		}
+	}
+	return m
+}
+
+func extractService(o runtime.Object) map[string]KubeObject {
+	s := o.(*v1.Service)
+	m := map[string]KubeObject{}
+	for _, cip := range s.Spec.ClusterIPs {
+		if cip != "None" && cip != "" {
+			m[cip] = KubeObject{Kind: "Service", Name: s.Name, Namespace: s.Namespace}
+		}
+	}
+	for _, ip := range s.Spec.ExternalIPs {
+		m[ip] = KubeObject{Kind: "Service", Name: s.Name + "-external", Namespace: s.Namespace}
+	}
+	for _, a := range s.Status.LoadBalancer.Ingress {
+		lb := KubeObject{Kind: "Service", Name: s.Name + "-loadbalancer", Namespace: s.Namespace}
+		m[a.IP] = lb
+		m[a.Hostname] = lb
+	}
+	return m
+}
+
+func extractPod(o runtime.Object) map[string]KubeObject {
+	p := o.(*v1.Pod)
+	if p.Spec.HostNetwork {
+		// Node will find it. Just return a map of ourself so the pod name is highlighted
+		return map[string]KubeObject{
+			p.Name: {Kind: "Pod", Name: p.Name, Namespace: p.Namespace, highlightOnly: true},
+		}
+	}
+	m := map[string]KubeObject{}
+	for _, i := range p.Status.PodIPs {
+		m[i.IP] = KubeObject{Kind: "Pod", Name: p.Name, Namespace: p.Namespace}
+	}
+	return m
+}
+
+func extractEndpointSlice(o runtime.Object) map[string]KubeObject {
+	es := o.(*discoveryv1.EndpointSlice)
+	name := es.Labels[discoveryv1.LabelServiceName]
+	if name == "" {
+		name = es.Name
+	}
+	m := map[string]KubeObject{}
+	for _, e := range es.Endpoints {
+		if e.TargetRef != nil && e.TargetRef.Kind == "Pod" {
+			// Pod will find it
+			continue
+		}
+		for _, a := range e.Addresses {
+			m[a] = KubeObject{Kind: "EndpointSlice", Name: name + "-endpoint", Namespace: es.Namespace}
+		}
+	}
+	return m
+}
+
+func extractIngress(o runtime.Object) map[string]KubeObject {
+	i := o.(*networkingv1.Ingress)
+	m := map[string]KubeObject{}
+	for _, a := range i.Status.LoadBalancer.Ingress {
+		obj := KubeObject{Kind: "Ingress", Name: i.Name + "-ingress", Namespace: i.Namespace}
+		m[a.IP] = obj
+		m[a.Hostname] = obj
+	}
+	return m
+}
+
 func (kr *KubeReplacer) Replace(s string) string {
 	if !kr.translateIPs {
 		return s
@@ -104,16 +460,16 @@ func (kr *KubeReplacer) Replace(s string) string {
 	return repl.Replace(s)
 }
 
-func (kr *KubeReplacer) ObjectHandler(extract func(o runtime.Object) map[string]string) cache.ResourceEventHandler {
-	single := func(obj interface{}) {
-		o := extractObject(obj)
-		if o == nil {
-			return
-		}
-		kr.handle(extract(o))
-	}
+// ObjectHandler handles objects of a cluster, using extract to find their addresses.
+func (kr *KubeReplacer) ObjectHandler(cluster string, extract func(o runtime.Object) map[string]KubeObject) cache.ResourceEventHandler {
 	return cache.ResourceEventHandlerFuncs{
-		AddFunc: single,
+		AddFunc: func(obj interface{}) {
+			o := extractObject(obj)
+			if o == nil {
+				return
+			}
+			kr.handle(clusterOwner(cluster, o), inCluster(cluster, extract(o)), objectCreated(o))
+		},
 		UpdateFunc: func(oldInterface, newInterace interface{}) {
 			oldObj := extractObject(oldInterface)
 			if oldObj == nil {
@@ -123,18 +479,77 @@ func (kr *KubeReplacer) ObjectHandler(extract func(o runtime.Object) map[string]
 			if newObj == nil {
 				return
 			}
-			kr.handle(extract(newObj))
+			kr.handle(clusterOwner(cluster, newObj), inCluster(cluster, extract(newObj)), objectCreated(newObj))
 		},
-		DeleteFunc: single,
+		DeleteFunc: func(obj interface{}) {
+			o := extractObject(obj)
+			if o == nil {
+				return
+			}
+			kr.remove(clusterOwner(cluster, o), objectDeleted(o))
+		},
+	}
+}
+
+// inCluster sets the cluster of each extracted object.
+func inCluster(cluster string, extracted map[string]KubeObject) map[string]KubeObject {
+	if cluster == "" {
+		return extracted
+	}
+	for k, o := range extracted {
+		o.Cluster = cluster
+		extracted[k] = o
 	}
+	return extracted
 }
 
-func (kr *KubeReplacer) handle(extract map[string]string) {
+// clusterOwner returns the owner (see objectOwner) of an object of a cluster.
+func clusterOwner(cluster string, o runtime.Object) string {
+	if cluster == "" {
+		return objectOwner(o)
+	}
+	return cluster + "/" + objectOwner(o)
+}
+
+// objectOwner returns a unique identifier for the object, used to track which addresses it owns.
+// Objects without a UID, which may be the case in snapshots, are identified by their type and name.
+func objectOwner(o runtime.Object) string {
+	m, err := meta.Accessor(o)
+	if err != nil {
+		return ""
+	}
+	if m.GetUID() == "" {
+		return fmt.Sprintf("%T/%s/%s", o, m.GetNamespace(), m.GetName())
+	}
+	return string(m.GetUID())
+}
+
+// objectCreated returns when the object was created, which is when it is assumed to have claimed its addresses.
+func objectCreated(o runtime.Object) time.Time {
+	m, err := meta.Accessor(o)
+	if err != nil {
+		return time.Now()
+	}
+	return m.GetCreationTimestamp().Time
+}
+
+// objectDeleted returns when the object was deleted.
+func objectDeleted(o runtime.Object) time.Time {
+	m, err := meta.Accessor(o)
+	if err != nil || m.GetDeletionTimestamp() == nil {
+		return time.Now()
+	}
+	return m.GetDeletionTimestamp().Time
+}
+
+// handle sets the addresses owned by owner, removing any it no longer has.
+// When an address is reused, the most recent owner wins.
+func (kr *KubeReplacer) handle(owner string, extract map[string]KubeObject, created time.Time) {
 	delete(extract, "")
 	kr.mu.RLock()
-	update := false
+	update := len(kr.owned[owner]) != len(extract)
 	for k, v := range extract {
-		if kr.replacements[k] != v {
+		if cur, f := kr.objects[k]; !f || cur != v || kr.owners[k] != owner {
 			update = true
 			break
 		}
@@ -145,9 +560,126 @@ func (kr *KubeReplacer) handle(extract map[string]string) {
 	}
 	kr.mu.Lock()
 	defer kr.mu.Unlock()
+	now := time.Now()
+	for k := range kr.owned[owner] {
+		if _, f := extract[k]; f {
+			continue
+		}
+		if kr.unclaim(k, owner, now) {
+			continue
+		}
+		if kr.owners[k] == owner {
+			delete(kr.objects, k)
+			delete(kr.owners, k)
+		}
+	}
+	keys := make(map[string]struct{}, len(extract))
 	for k, v := range extract {
-		kr.replacements[k] = v
+		kr.objects[k] = v
+		kr.owners[k] = owner
+		kr.claim(k, owner, v, created)
+		if kr.claimants[k] == nil {
+			kr.claimants[k] = map[string]KubeObject{}
+		}
+		// A cached address for the same object has now been confirmed
+		for c, o := range kr.claimants[k] {
+			if strings.HasPrefix(c, cachedOwner) && o == v {
+				delete(kr.claimants[k], c)
+			}
+		}
+		kr.claimants[k][owner] = v
+		keys[k] = struct{}{}
+	}
+	kr.owned[owner] = keys
+	kr.changed()
+}
+
+// remove drops all addresses still owned by owner, unless another object still claims them. If markDeleted is set,
+// addresses are instead kept, marked as deleted, until they are reused.
+func (kr *KubeReplacer) remove(owner string, deleted time.Time) {
+	kr.mu.Lock()
+	defer kr.mu.Unlock()
+	for k := range kr.owned[owner] {
+		if kr.unclaim(k, owner, deleted) || kr.owners[k] != owner {
+			continue
+		}
+		delete(kr.owners, k)
+		o := kr.objects[k]
+		if kr.markDeleted && !o.highlightOnly {
+			o.Deleted = true
+			kr.objects[k] = o
+			continue
+		}
+		delete(kr.objects, k)
+	}
+	delete(kr.owned, owner)
+	kr.changed()
+}
+
+// unclaim drops owner's claim to an address at t. If owner was the current owner, the address is released, and handed
+// to another remaining claimant, if any. It returns whether the address is still claimed. Must be called with the lock
+// held.
+func (kr *KubeReplacer) unclaim(k string, owner string, t time.Time) bool {
+	delete(kr.claimants[k], owner)
+	if len(kr.claimants[k]) == 0 {
+		delete(kr.claimants, k)
+	}
+	if kr.owners[k] != owner {
+		return len(kr.claimants[k]) > 0
+	}
+	kr.release(k, owner, t)
+	if len(kr.claimants[k]) == 0 {
+		return false
+	}
+	// Any remaining claimant is as good as another; pick one consistently
+	next := ""
+	for c := range kr.claimants[k] {
+		if next == "" || c < next {
+			next = c
+		}
+	}
+	o := kr.claimants[k][next]
+	kr.objects[k] = o
+	kr.owners[k] = next
+	kr.claim(k, next, o, t)
+	return true
+}
+
+// rebuildDelay is how long changes are batched for before rebuilding, when rebuilds are deferred.
+const rebuildDelay = 100 * time.Millisecond
+
+// historyRetention is how long ownerships are kept in history once they end, when watching a cluster.
+const historyRetention = 24 * time.Hour
+
+// changed rebuilds after a change. With deferRebuilds, a rebuild is instead scheduled after rebuildDelay, so a burst
+// of changes, such as the initial sync of a large cluster, only rebuilds a few times. Must be called with the lock
+// held.
+func (kr *KubeReplacer) changed() {
+	if !kr.deferRebuilds {
+		kr.rebuild()
+		return
+	}
+	kr.dirty = true
+	if !kr.flushPending {
+		kr.flushPending = true
+		time.AfterFunc(rebuildDelay, kr.flush)
+	}
+}
+
+// flush runs any pending rebuild.
+func (kr *KubeReplacer) flush() {
+	kr.mu.Lock()
+	defer kr.mu.Unlock()
+	kr.flushPending = false
+	if kr.dirty {
+		kr.rebuild()
 	}
+}
+
+// rebuild renders all names, and updates the Replacer. Must be called with the lock held.
+func (kr *KubeReplacer) rebuild() {
+	kr.dirty = false
+	kr.replacements = kr.render()
 	keys := make([]string, 0, len(kr.replacements))
 	for k := range kr.replacements {
 		keys = append(keys, k)
@@ -161,6 +693,130 @@ func (kr *KubeReplacer) handle(extract map[string]string) {
 		kvlist = append(kvlist, k, kr.replacements[k])
 	}
 	kr.Replacer = strings.NewReplacer(kvlist...)
+	kr.rebuildHistory()
+}
+
+// defaultNames are the progressively more qualified names used to disambiguate objects when there is no template.
+var defaultNames = []func(o KubeObject) string{
+	func(o KubeObject) string {
+		return o.Name
+	},
+	func(o KubeObject) string {
+		if o.Namespace == "" {
+			return o.Name
+		}
+		return o.Name + "." + o.Namespace
+	},
+	func(o KubeObject) string {
+		if o.Namespace == "" {
+			return strings.ToLower(o.Kind) + "/" + o.Name
+		}
+		return strings.ToLower(o.Kind) + "/" + o.Name + "." + o.Namespace
+	},
+}
+
+// nameQualifier is how far an object's default name is qualified to tell it apart from others.
+type nameQualifier struct {
+	// level is which of defaultNames to use
+	level int
+	// cluster prefixes the name with its cluster
+	cluster bool
+}
+
+// defaultName renders o with the defaultNames level of q, prefixed with its cluster if q or clusterPrefix ask for it.
+func defaultName(o KubeObject, q nameQualifier, clusterPrefix bool) string {
+	n := defaultNames[q.level](o)
+	if (clusterPrefix || q.cluster) && o.Cluster != "" {
+		return o.Cluster + "/" + n
+	}
+	return n
+}
+
+// render returns the name for each address. Must be called with the lock held.
+func (kr *KubeReplacer) render() map[string]string {
+	if kr.template == nil {
+		kr.levels = qualifyLevels(kr.objects, kr.clusterPrefix)
+	}
+	res := make(map[string]string, len(kr.objects))
+	for k, o := range kr.objects {
+		if o.highlightOnly {
+			res[k] = k
+			continue
+		}
+		res[k] = deletedSuffix(o, kr.renderObject(o))
+	}
+	return res
+}
+
+// renderObject returns the name of an object. Must be called with the lock held.
+func (kr *KubeReplacer) renderObject(o KubeObject) string {
+	if kr.template != nil {
+		sb := strings.Builder{}
+		if err := kr.template.Execute(&sb, o); err != nil {
+			return o.Name
+		}
+		return sb.String()
+	}
+	o.Deleted = false
+	return defaultName(o, kr.levels[o], kr.clusterPrefix)
+}
+
+// qualifyLevels returns how to qualify each object's name, qualifying names further until no two distinct objects
+// share a name. Objects which only differ by cluster, such as the same Service in each cluster of a mesh, are
+// qualified with their cluster, rather than their namespace and kind.
+func qualifyLevels(objects map[string]KubeObject, clusterPrefix bool) map[KubeObject]nameQualifier {
+	level := map[KubeObject]nameQualifier{}
+	for {
+		owners := map[string]map[KubeObject]struct{}{}
+		for _, o := range objects {
+			if o.highlightOnly {
+				continue
+			}
+			o.Deleted = false
+			n := defaultName(o, level[o], clusterPrefix)
+			if owners[n] == nil {
+				owners[n] = map[KubeObject]struct{}{}
+			}
+			owners[n][o] = struct{}{}
+		}
+		changed := false
+		for _, objs := range owners {
+			if len(objs) < 2 {
+				continue
+			}
+			identities := map[KubeObject]struct{}{}
+			for o := range objs {
+				o.Cluster = ""
+				identities[o] = struct{}{}
+			}
+			for o := range objs {
+				q := level[o]
+				if len(identities) == 1 {
+					if q.cluster {
+						continue
+					}
+					q.cluster = true
+				} else {
+					if q.level == len(defaultNames)-1 {
+						continue
+					}
+					q.level++
+				}
+				level[o] = q
+				changed = true
+			}
+		}
+		if !changed {
+			return level
+		}
+	}
+}
+
+func deletedSuffix(o KubeObject, name string) string {
+	if o.Deleted {
+		return name + "(deleted)"
+	}
+	return name
 }
 
 func extractObject(obj interface{}) runtime.Object {
@@ -197,24 +853,33 @@ type KubeMatcher struct {
 
 func (s *KubeMatcher) GetMatchers() []*Matcher {
 	s.replacer.mu.RLock()
-	uniqReplacements := make(map[string]struct{}, len(s.replacer.replacements))
+	// uniqReplacements holds the cluster of each name
+	uniqReplacements := make(map[string]string, len(s.replacer.replacements))
 	if s.replacer.translateIPs {
-		for _, name := range s.replacer.replacements {
+		for ip, name := range s.replacer.replacements {
 			if len(name) < 3 {
 				// Too small to be useful
 				continue
 			}
-			uniqReplacements[name] = struct{}{}
+			uniqReplacements[name] = s.replacer.objects[ip].Cluster
+		}
+		// Names may also come from previous owners of an address
+		for name, cluster := range s.replacer.historicNames {
+			if len(name) < 3 {
+				continue
+			}
+			uniqReplacements[name] = cluster
 		}
 	} else {
 		// Add name AND IP
 		for ip, name := range s.replacer.replacements {
-			uniqReplacements[ip] = struct{}{}
+			cluster := s.replacer.objects[ip].Cluster
+			uniqReplacements[ip] = cluster
 			if len(name) < 3 {
 				// Too small to be useful
 				continue
 			}
-			uniqReplacements[name] = struct{}{}
+			uniqReplacements[name] = cluster
 		}
 	}
 	s.replacer.mu.RUnlock()
@@ -225,6 +890,7 @@ func (s *KubeMatcher) GetMatchers() []*Matcher {
 	sort.Slice(keys, func(i, j int) bool {
 		return len(keys[i]) > len(keys[j])
 	})
+	colors := s.colorsFor(keys, uniqReplacements)
 	replacementMatchers := make([]*Matcher, 0, len(keys))
 	for i, r := range keys {
 		if m, f := s.dynamicMatchers[r]; f {
@@ -232,11 +898,7 @@ func (s *KubeMatcher) GetMatchers() []*Matcher {
 			continue
 		}
 		rx := compileRegex(regexp.QuoteMeta(r))
-		m := &Matcher{
-			r:        rx,
-			variants: map[string]int{},
-			color:    ExtrapolateColorList(s.colors, i+len(s.staticMatchers), len(keys)+len(s.staticMatchers)),
-		}
+		m := NewMatcher(rx, colors[i])
 		replacementMatchers = append(replacementMatchers, m)
 		s.dynamicMatchers[r] = m
 	}
@@ -246,6 +908,41 @@ func (s *KubeMatcher) GetMatchers() []*Matcher {
 	return matchers
 }
 
+// colorsFor picks a color for each name. With a single cluster, colors are spread across the palette. With multiple
+// clusters, each cluster gets one hue from the palette, and its names are tints of it.
+func (s *KubeMatcher) colorsFor(keys []string, clusters map[string]string) []color.Color {
+	offset := len(s.staticMatchers)
+	res := make([]color.Color, len(keys))
+	clusterNames := map[string]int{}
+	for _, c := range clusters {
+		clusterNames[c]++
+	}
+	if len(clusterNames) < 2 {
+		for i := range keys {
+			res[i] = ExtrapolateColorList(s.colors, i+offset, len(keys)+offset)
+		}
+		return res
+	}
+	names := make([]string, 0, len(clusterNames))
+	for c := range clusterNames {
+		names = append(names, c)
+	}
+	sort.Strings(names)
+	hue := map[string]int{}
+	for i, c := range names {
+		hue[c] = i
+	}
+	seen := map[string]int{}
+	for i, k := range keys {
+		c := clusters[k]
+		base := s.colors[(hue[c]+offset)%len(s.colors)]
+		// Keep tints away from white, so names remain readable
+		res[i] = color.Lighten(base, 0.6*float64(seen[c])/float64(clusterNames[c]))
+		seen[c]++
+	}
+	return res
+}
+
 func NewKubeMatcher(matchers []*Matcher, replacer *KubeReplacer, colors []color.Color) *KubeMatcher {
 	return &KubeMatcher{
 		staticMatchers:  matchers,
@@ -0,0 +1,599 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	authorizationv1 "k8s.io/api/authorization/v1"
+	v1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func newTestKubeReplacer(nameTemplate string) *KubeReplacer {
+	kr, err := newKubeReplacer(KubeOptions{TranslateIPs: true, NameTemplate: nameTemplate})
+	if err != nil {
+		panic(err)
+	}
+	return kr
+}
+
+// at returns a time of day on a fixed date.
+func at(s string) time.Time {
+	t, err := time.Parse(time.RFC3339, "2024-01-01T"+s+"Z")
+	if err != nil {
+		panic(err)
+	}
+	return t
+}
+
+func TestKubeReplacerNames(t *testing.T) {
+	objects := map[string]KubeObject{
+		"10.0.0.1": {Kind: "Pod", Name: "echo", Namespace: "a"},
+		"10.0.0.2": {Kind: "Pod", Name: "echo", Namespace: "b"},
+		"10.0.0.3": {Kind: "Pod", Name: "shell", Namespace: "a"},
+		"10.0.0.4": {Kind: "Service", Name: "shell", Namespace: "a"},
+		"10.0.0.5": {Kind: "Node", Name: "node"},
+		"host-pod": {Kind: "Pod", Name: "host-pod", Namespace: "a", highlightOnly: true},
+	}
+	tests := []struct {
+		name     string
+		template string
+		want     map[string]string
+	}{
+		{
+			"default",
+			"",
+			map[string]string{
+				"10.0.0.1": "echo.a",
+				"10.0.0.2": "echo.b",
+				"10.0.0.3": "pod/shell.a",
+				"10.0.0.4": "service/shell.a",
+				"10.0.0.5": "node",
+				"host-pod": "host-pod",
+			},
+		},
+		{
+			"template",
+			"{{.Kind}}:{{.Name}}",
+			map[string]string{
+				"10.0.0.1": "Pod:echo",
+				"10.0.0.2": "Pod:echo",
+				"10.0.0.3": "Pod:shell",
+				"10.0.0.4": "Service:shell",
+				"10.0.0.5": "Node:node",
+				"host-pod": "host-pod",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			kr := newTestKubeReplacer(tt.template)
+			for k, o := range objects {
+				kr.handle(k, map[string]KubeObject{k: o}, time.Time{})
+			}
+			if !reflect.DeepEqual(kr.replacements, tt.want) {
+				t.Errorf("replacements = %v, want %v", kr.replacements, tt.want)
+			}
+		})
+	}
+}
+
+func TestKubeReplacerInvalidTemplate(t *testing.T) {
+	for _, tmpl := range []string{"{{.Name", "{{.Nme}}"} {
+		if _, err := newKubeReplacer(KubeOptions{NameTemplate: tmpl}); err == nil {
+			t.Errorf("expected an error for template %q", tmpl)
+		}
+	}
+}
+
+func TestKubeReplacerClusters(t *testing.T) {
+	echo := KubeObject{Kind: "Pod", Name: "echo", Namespace: "default"}
+	shell := KubeObject{Kind: "Pod", Name: "shell", Namespace: "default"}
+	tests := []struct {
+		name          string
+		clusterPrefix bool
+		want          map[string]string
+	}{
+		{
+			"no prefix",
+			false,
+			map[string]string{"10.0.0.1": "c1/echo", "10.1.0.1": "c2/echo", "10.1.0.2": "shell"},
+		},
+		{
+			"prefix",
+			true,
+			map[string]string{"10.0.0.1": "c1/echo", "10.1.0.1": "c2/echo", "10.1.0.2": "c2/shell"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			kr := newTestKubeReplacer("")
+			kr.clusterPrefix = tt.clusterPrefix
+			kr.handle("c1/a", inCluster("c1", map[string]KubeObject{"10.0.0.1": echo}), time.Time{})
+			kr.handle("c2/a", inCluster("c2", map[string]KubeObject{"10.1.0.1": echo}), time.Time{})
+			kr.handle("c2/b", inCluster("c2", map[string]KubeObject{"10.1.0.2": shell}), time.Time{})
+			if !reflect.DeepEqual(kr.replacements, tt.want) {
+				t.Errorf("replacements = %v, want %v", kr.replacements, tt.want)
+			}
+		})
+	}
+}
+
+func TestKubeReplacerOwnership(t *testing.T) {
+	podA := KubeObject{Kind: "Pod", Name: "a", Namespace: "default"}
+	podB := KubeObject{Kind: "Pod", Name: "b", Namespace: "default"}
+	svc := KubeObject{Kind: "Service", Name: "gateway", Namespace: "default"}
+	ingress := KubeObject{Kind: "Ingress", Name: "web", Namespace: "default"}
+	tests := []struct {
+		name        string
+		markDeleted bool
+		events      func(kr *KubeReplacer)
+		want        map[string]string
+	}{
+		{
+			"delete",
+			false,
+			func(kr *KubeReplacer) {
+				kr.handle("a", map[string]KubeObject{"10.0.0.1": podA}, time.Time{})
+				kr.remove("a", time.Time{})
+			},
+			map[string]string{},
+		},
+		{
+			"delete marked",
+			true,
+			func(kr *KubeReplacer) {
+				kr.handle("a", map[string]KubeObject{"10.0.0.1": podA}, time.Time{})
+				kr.remove("a", time.Time{})
+			},
+			map[string]string{"10.0.0.1": "a(deleted)"},
+		},
+		{
+			"update changes IP",
+			false,
+			func(kr *KubeReplacer) {
+				kr.handle("a", map[string]KubeObject{"10.0.0.1": podA}, time.Time{})
+				kr.handle("a", map[string]KubeObject{"10.0.0.2": podA}, time.Time{})
+			},
+			map[string]string{"10.0.0.2": "a"},
+		},
+		{
+			"reused IP",
+			true,
+			func(kr *KubeReplacer) {
+				kr.handle("a", map[string]KubeObject{"10.0.0.1": podA}, time.Time{})
+				kr.handle("b", map[string]KubeObject{"10.0.0.1": podB}, time.Time{})
+				// Deleting the previous owner must not remove the new owner's address
+				kr.remove("a", time.Time{})
+			},
+			map[string]string{"10.0.0.1": "b"},
+		},
+		{
+			"shared IP, owner deleted",
+			true,
+			func(kr *KubeReplacer) {
+				kr.handle("svc", map[string]KubeObject{"10.0.0.1": svc}, time.Time{})
+				kr.handle("ingress", map[string]KubeObject{"10.0.0.1": ingress}, time.Time{})
+				// The Service still reports the address, so it takes it back
+				kr.remove("ingress", time.Time{})
+			},
+			map[string]string{"10.0.0.1": "gateway"},
+		},
+		{
+			"shared IP, owner dropped address",
+			false,
+			func(kr *KubeReplacer) {
+				kr.handle("svc", map[string]KubeObject{"10.0.0.1": svc}, time.Time{})
+				kr.handle("ingress", map[string]KubeObject{"10.0.0.1": ingress}, time.Time{})
+				kr.handle("ingress", map[string]KubeObject{}, time.Time{})
+			},
+			map[string]string{"10.0.0.1": "gateway"},
+		},
+		{
+			"shared IP, other claimant deleted",
+			false,
+			func(kr *KubeReplacer) {
+				kr.handle("svc", map[string]KubeObject{"10.0.0.1": svc}, time.Time{})
+				kr.handle("ingress", map[string]KubeObject{"10.0.0.1": ingress}, time.Time{})
+				kr.remove("svc", time.Time{})
+			},
+			map[string]string{"10.0.0.1": "web"},
+		},
+		{
+			"shared IP, all deleted",
+			false,
+			func(kr *KubeReplacer) {
+				kr.handle("svc", map[string]KubeObject{"10.0.0.1": svc}, time.Time{})
+				kr.handle("ingress", map[string]KubeObject{"10.0.0.1": ingress}, time.Time{})
+				kr.remove("ingress", time.Time{})
+				kr.remove("svc", time.Time{})
+			},
+			map[string]string{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			kr := newTestKubeReplacer("")
+			kr.markDeleted = tt.markDeleted
+			tt.events(kr)
+			if !reflect.DeepEqual(kr.replacements, tt.want) {
+				t.Errorf("replacements = %v, want %v", kr.replacements, tt.want)
+			}
+			if got := kr.Replace("10.0.0.1"); got != "10.0.0.1" && tt.want["10.0.0.1"] != got {
+				t.Errorf("Replace() = %v", got)
+			}
+		})
+	}
+}
+
+func TestKubeReplacerReplaceAt(t *testing.T) {
+	podA := KubeObject{Kind: "Pod", Name: "pod-a", Namespace: "default"}
+	podB := KubeObject{Kind: "Pod", Name: "pod-b", Namespace: "default"}
+	kr := newTestKubeReplacer("")
+	kr.handle("a", map[string]KubeObject{"10.0.0.1": podA}, at("00:00:00"))
+	kr.remove("a", at("01:00:00"))
+	kr.handle("b", map[string]KubeObject{"10.0.0.1": podB}, at("01:00:05"))
+
+	tests := []struct {
+		at   string
+		want string
+	}{
+		{"00:30:00", "from pod-a:80"},
+		{"01:00:02", "from pod-b:80"},
+		{"02:00:00", "from pod-b:80"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.at, func(t *testing.T) {
+			if got := kr.ReplaceAt("from 10.0.0.1:80", at(tt.at)); got != tt.want {
+				t.Errorf("ReplaceAt() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+	if got, want := kr.Replace("from 10.0.0.1:80"), "from pod-b:80"; got != want {
+		t.Errorf("Replace() = %v, want %v", got, want)
+	}
+}
+
+func TestKubeReplacerSnapshot(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"dump.yaml": `apiVersion: v1
+kind: List
+items:
+- apiVersion: v1
+  kind: Pod
+  metadata:
+    name: echo
+    namespace: default
+    labels:
+      app: echo
+  status:
+    podIPs:
+    - ip: 10.0.0.1
+- apiVersion: example.com/v1
+  kind: Widget
+  metadata:
+    name: widget
+---
+apiVersion: v1
+kind: Node
+metadata:
+  name: node
+status:
+  addresses:
+  - type: InternalIP
+    address: 10.1.0.1
+  - type: ExternalIP
+    address: 34.0.0.1
+---
+apiVersion: discovery.k8s.io/v1
+kind: EndpointSlice
+metadata:
+  name: external-abc
+  namespace: default
+  labels:
+    kubernetes.io/service-name: external
+addressType: IPv4
+endpoints:
+- addresses: [10.0.0.1]
+  targetRef: {kind: Pod, name: echo, namespace: default}
+- addresses: [192.168.0.1]
+---
+apiVersion: networking.k8s.io/v1
+kind: Ingress
+metadata:
+  name: web
+  namespace: default
+status:
+  loadBalancer:
+    ingress:
+    - hostname: web.example.com
+---
+apiVersion: gateway.networking.k8s.io/v1
+kind: Gateway
+metadata:
+  name: gw
+  namespace: default
+status:
+  addresses:
+  - type: IPAddress
+    value: 35.0.0.1
+`,
+		"namespaces/default/core/services.json": `{"apiVersion": "v1", "kind": "ServiceList", "items": [
+  {"metadata": {"name": "svc", "namespace": "default"}, "spec": {"clusterIPs": ["10.2.0.1"]}}
+]}`,
+		"config.yaml": "some: config\n",
+	}
+	for name, content := range files {
+		p := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tests := []struct {
+		name string
+		opts KubeOptions
+		want map[string]string
+	}{
+		{
+			"all",
+			KubeOptions{},
+			map[string]string{
+				"10.0.0.1":        "echo",
+				"10.1.0.1":        "node",
+				"34.0.0.1":        "node-external",
+				"10.2.0.1":        "svc",
+				"192.168.0.1":     "external-endpoint",
+				"web.example.com": "web-ingress",
+				"35.0.0.1":        "gw-gateway",
+			},
+		},
+		{
+			"namespace",
+			KubeOptions{Namespace: "other"},
+			map[string]string{"10.1.0.1": "node", "34.0.0.1": "node-external"},
+		},
+		{
+			"selector",
+			KubeOptions{Selector: "app=echo"},
+			map[string]string{"10.0.0.1": "echo"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.opts.TranslateIPs = true
+			tt.opts.Snapshot = dir
+			kr, err := NewKubeReplacer(tt.opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(kr.replacements, tt.want) {
+				t.Errorf("replacements = %v, want %v", kr.replacements, tt.want)
+			}
+		})
+	}
+}
+
+func TestKubeReplacerTable(t *testing.T) {
+	podA := KubeObject{Kind: "Pod", Name: "pod-a", Namespace: "default"}
+	podB := KubeObject{Kind: "Pod", Name: "pod-b", Namespace: "default"}
+	podC := KubeObject{Kind: "Pod", Name: "pod-c", Namespace: "default"}
+	kr := newTestKubeReplacer("")
+	kr.handle("a", map[string]KubeObject{"10.0.0.1": podA}, at("00:00:00"))
+	kr.remove("a", at("01:00:00"))
+	kr.handle("b", map[string]KubeObject{"10.0.0.1": podB}, at("01:00:05"))
+	kr.handle("c", map[string]KubeObject{"10.0.0.2": podC}, at("01:00:05"))
+	path := filepath.Join(t.TempDir(), "table.json")
+	if err := kr.WriteTable(path); err != nil {
+		t.Fatal(err)
+	}
+
+	cached := newTestKubeReplacer("")
+	if err := cached.loadTable(path); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(cached.replacements, kr.replacements) {
+		t.Errorf("cached replacements = %v, want %v", cached.replacements, kr.replacements)
+	}
+	if got, want := cached.ReplaceAt("10.0.0.1", at("00:30:00")), "pod-a"; got != want {
+		t.Errorf("ReplaceAt() = %v, want %v", got, want)
+	}
+
+	// Only pod-b is still running once synced
+	cached.handle("b", map[string]KubeObject{"10.0.0.1": podB}, at("01:00:05"))
+	cached.dropCached("")
+	want := map[string]string{"10.0.0.1": "pod-b"}
+	if !reflect.DeepEqual(cached.replacements, want) {
+		t.Errorf("synced replacements = %v, want %v", cached.replacements, want)
+	}
+	if got, want := cached.ReplaceAt("10.0.0.1", at("00:30:00")), "pod-a"; got != want {
+		t.Errorf("ReplaceAt() after sync = %v, want %v", got, want)
+	}
+	if got := len(cached.history["10.0.0.1"]); got != 2 {
+		t.Errorf("got %d history entries, want 2", got)
+	}
+}
+
+func TestKubeReplacerResources(t *testing.T) {
+	cfg := Config{KubeResources: []ConfigKubeResource{
+		{Group: "networking.istio.io", Version: "v1", Resource: "workloadentries", Kind: "WorkloadEntry", Address: ".spec.address"},
+		{
+			Group: "networking.istio.io", Version: "v1", Resource: "serviceentries", Kind: "ServiceEntry",
+			Address: "{.spec.endpoints[*].address}", Name: "{.spec.hosts[0]}",
+		},
+	}}
+	resources, err := cfg.GetKubeResources()
+	if err != nil {
+		t.Fatal(err)
+	}
+	missingKind := Config{KubeResources: []ConfigKubeResource{{Group: "networking.istio.io", Version: "v1", Resource: "workloadentries", Address: ".spec.address"}}}
+	if _, err := missingKind.GetKubeResources(); err == nil {
+		t.Error("expected an error for a resource without a kind")
+	}
+	snapshot := filepath.Join(t.TempDir(), "istio.yaml")
+	if err := os.WriteFile(snapshot, []byte(`apiVersion: networking.istio.io/v1
+kind: WorkloadEntry
+metadata:
+  name: vm
+  namespace: default
+spec:
+  address: 10.3.0.1
+---
+apiVersion: networking.istio.io/v1beta1
+kind: ServiceEntry
+metadata:
+  name: external
+  namespace: default
+spec:
+  hosts: [api.example.com]
+  endpoints:
+  - address: 10.4.0.1
+  - address: 10.4.0.2
+`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	kr, err := NewKubeReplacer(KubeOptions{TranslateIPs: true, Snapshot: snapshot, Resources: resources})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"10.3.0.1": "vm",
+		"10.4.0.1": "api.example.com",
+		"10.4.0.2": "api.example.com",
+	}
+	if !reflect.DeepEqual(kr.replacements, want) {
+		t.Errorf("replacements = %v, want %v", kr.replacements, want)
+	}
+}
+
+func TestKubeReplacerBadCache(t *testing.T) {
+	dir := t.TempDir()
+	cache := filepath.Join(dir, "cache.json")
+	if err := os.WriteFile(cache, []byte(`[{"address": "10.0.0.1", "na`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	kr, err := NewKubeReplacer(KubeOptions{TranslateIPs: true, Cache: cache, Kubeconfig: filepath.Join(dir, "missing")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	kr.WaitForSync()
+	// The unreadable cache is replaced once synced
+	if err := newTestKubeReplacer("").loadTable(cache); err != nil {
+		t.Errorf("cache was not rewritten: %v", err)
+	}
+	if tmp, _ := filepath.Glob(filepath.Join(dir, "*.tmp")); len(tmp) > 0 {
+		t.Errorf("temporary files left behind: %v", tmp)
+	}
+}
+
+func TestCanWatch(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	client.PrependReactor("create", "selfsubjectaccessreviews", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		review := action.(k8stesting.CreateAction).GetObject().(*authorizationv1.SelfSubjectAccessReview)
+		attrs := review.Spec.ResourceAttributes
+		review.Status.Allowed = attrs.Resource != "ingresses" && (attrs.Resource != "nodes" || attrs.Namespace == "")
+		return true, review, nil
+	})
+	tests := []struct {
+		resource   schema.GroupVersionResource
+		namespaced bool
+		want       bool
+	}{
+		{v1.SchemeGroupVersion.WithResource("pods"), true, true},
+		{networkingv1.SchemeGroupVersion.WithResource("ingresses"), true, false},
+		// Cluster scoped resources are checked without the namespace
+		{v1.SchemeGroupVersion.WithResource("nodes"), false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.resource.Resource, func(t *testing.T) {
+			if got := canWatch(client, "", tt.resource, tt.namespaced, "default"); got != tt.want {
+				t.Errorf("canWatch() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestKubeReplacerDeferredRebuild(t *testing.T) {
+	kr := newTestKubeReplacer("")
+	kr.deferRebuilds = true
+	kr.handle("a", map[string]KubeObject{"10.0.0.1": {Kind: "Pod", Name: "pod-a", Namespace: "default"}}, time.Time{})
+	if len(kr.replacements) != 0 {
+		t.Errorf("expected the rebuild to be deferred, got %v", kr.replacements)
+	}
+	kr.flush()
+	if got, want := kr.Replace("10.0.0.1"), "pod-a"; got != want {
+		t.Errorf("Replace() = %v, want %v", got, want)
+	}
+}
+
+func TestKubeReplacerHistoryRetention(t *testing.T) {
+	podA := KubeObject{Kind: "Pod", Name: "pod-a", Namespace: "default"}
+	podB := KubeObject{Kind: "Pod", Name: "pod-b", Namespace: "default"}
+	now := time.Now()
+	kr := newTestKubeReplacer("")
+	kr.historyRetention = time.Hour
+	kr.handle("a", map[string]KubeObject{"10.0.0.1": podA}, now.Add(-3*time.Hour))
+	kr.remove("a", now.Add(-2*time.Hour))
+	kr.handle("b", map[string]KubeObject{"10.0.0.2": podB}, now.Add(-3*time.Hour))
+	kr.remove("b", now.Add(-time.Minute))
+	if _, f := kr.history["10.0.0.1"]; f {
+		t.Errorf("expected ownership that ended before the retention window to be pruned")
+	}
+	if _, f := kr.historicNames["pod-a"]; f {
+		t.Errorf("expected pruned names to be dropped")
+	}
+	if got, want := kr.ReplaceAt("10.0.0.1 10.0.0.2", now.Add(-30*time.Minute)), "10.0.0.1 pod-b"; got != want {
+		t.Errorf("ReplaceAt() = %v, want %v", got, want)
+	}
+}
+
+func TestKubeReplacerSyncTimeout(t *testing.T) {
+	tests := []struct {
+		name       string
+		timeout    time.Duration
+		wantSynced bool
+	}{
+		{"timeout", 50 * time.Millisecond, true},
+		{"no timeout", 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Never synced, like a cluster whose informers never sync
+			kr := newTestKubeReplacer("")
+			kr.deferRebuilds = true
+			kr.handle("a", map[string]KubeObject{"10.0.0.1": {Kind: "Pod", Name: "pod-a", Namespace: "default"}}, time.Time{})
+			// Streamed lines are passed through unchanged, rather than waiting for the sync
+			h := Highlighter{replacer: kr, matchers: StaticMatchers{}}
+			line := "2024-01-01T00:00:00.000000Z 10.0.0.1\n"
+			if got := h.HighlightAt(line, &ParsedTime{t: at("00:00:00")}); got != line {
+				t.Errorf("HighlightAt() = %q, want %q", got, line)
+			}
+			kr.syncWithin(tt.timeout)
+			waited := make(chan struct{})
+			go func() {
+				kr.WaitForSync()
+				close(waited)
+			}()
+			select {
+			case <-waited:
+				if !tt.wantSynced {
+					t.Errorf("WaitForSync() returned without a sync")
+				}
+			case <-time.After(time.Second):
+				if tt.wantSynced {
+					t.Errorf("WaitForSync() did not return after the timeout")
+				}
+			}
+		})
+	}
+}
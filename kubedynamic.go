@@ -0,0 +1,140 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/discovery"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/util/jsonpath"
+)
+
+// dynamicKind is a kind addresses are extracted from which client-go has no types for, such as Gateway API or
+// custom resources from the config. Objects are passed to extract as *unstructured.Unstructured.
+type dynamicKind struct {
+	resource schema.GroupVersionResource
+	kind     string
+	extract  func(o runtime.Object) map[string]KubeObject
+}
+
+var dynamicKinds = []dynamicKind{
+	{schema.GroupVersionResource{Group: "gateway.networking.k8s.io", Version: "v1", Resource: "gateways"}, "Gateway", extractGateway},
+}
+
+func extractGateway(o runtime.Object) map[string]KubeObject {
+	u := o.(*unstructured.Unstructured)
+	addresses, _, _ := unstructured.NestedSlice(u.Object, "status", "addresses")
+	m := map[string]KubeObject{}
+	for _, a := range addresses {
+		a, ok := a.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		if v, ok := a["value"].(string); ok {
+			m[v] = KubeObject{Kind: "Gateway", Name: u.GetName() + "-gateway", Namespace: u.GetNamespace()}
+		}
+	}
+	return m
+}
+
+// parseJSONPath parses a JSONPath expression, which may omit the surrounding braces.
+func parseJSONPath(expr string) (*jsonpath.JSONPath, error) {
+	if !strings.HasPrefix(expr, "{") {
+		expr = "{" + expr + "}"
+	}
+	j := jsonpath.New("").AllowMissingKeys(true)
+	if err := j.Parse(expr); err != nil {
+		return nil, err
+	}
+	return j, nil
+}
+
+// jsonPathValues returns the values found by a JSONPath expression, as strings.
+func jsonPathValues(j *jsonpath.JSONPath, o map[string]interface{}) []string {
+	results, err := j.FindResults(o)
+	if err != nil {
+		return nil
+	}
+	res := []string{}
+	for _, r := range results {
+		for _, v := range r {
+			if s := fmt.Sprint(v.Interface()); s != "" {
+				res = append(res, s)
+			}
+		}
+	}
+	return res
+}
+
+// extractJSONPath builds an extractor for the addresses found by address. Addresses are replaced with the first value
+// found by name, or the object's name.
+func extractJSONPath(kind string, address *jsonpath.JSONPath, name *jsonpath.JSONPath) func(o runtime.Object) map[string]KubeObject {
+	return func(o runtime.Object) map[string]KubeObject {
+		u := o.(*unstructured.Unstructured)
+		obj := KubeObject{Kind: kind, Name: u.GetName(), Namespace: u.GetNamespace()}
+		if name != nil {
+			if n := jsonPathValues(name, u.Object); len(n) > 0 {
+				obj.Name = n[0]
+			}
+		}
+		m := map[string]KubeObject{}
+		for _, a := range jsonPathValues(address, u.Object) {
+			m[a] = obj
+		}
+		return m
+	}
+}
+
+// watchDynamic starts informers for dynamicKinds served by the cluster, returning once they have synced. Kinds the
+// cluster doesn't serve, or we may not watch, are skipped, as informers for them would never sync.
+func (kr *KubeReplacer) watchDynamic(cluster string, config *rest.Config, kc kubernetes.Interface, opts KubeOptions, stop chan struct{}) {
+	client, err := dynamic.NewForConfig(config)
+	if err != nil {
+		kubeWarning("unable to connect to cluster: %v", err)
+		return
+	}
+	factory := dynamicinformer.NewFilteredDynamicSharedInformerFactory(client, 0, opts.Namespace, func(o *metav1.ListOptions) {
+		o.LabelSelector = opts.Selector
+	})
+	for _, k := range kr.dynamicKinds {
+		r := servedResource(kc.Discovery(), k.resource)
+		if r == nil || !canWatch(kc, cluster, k.resource, r.Namespaced, opts.Namespace) {
+			continue
+		}
+		factory.ForResource(k.resource).Informer().AddEventHandler(kr.ObjectHandler(cluster, k.extract))
+	}
+	factory.Start(stop)
+	factory.WaitForCacheSync(stop)
+}
+
+// servedResource returns the resource if the cluster serves it, or nil.
+func servedResource(dc discovery.DiscoveryInterface, gvr schema.GroupVersionResource) *metav1.APIResource {
+	resources, err := dc.ServerResourcesForGroupVersion(gvr.GroupVersion().String())
+	if err != nil {
+		return nil
+	}
+	for i, r := range resources.APIResources {
+		if r.Name == gvr.Resource {
+			return &resources.APIResources[i]
+		}
+	}
+	return nil
+}
+
+// dynamicKindFor returns the dynamicKind of an object from a snapshot, matching any version of its group.
+func (kr *KubeReplacer) dynamicKindFor(u *unstructured.Unstructured) *dynamicKind {
+	gvk := u.GroupVersionKind()
+	for i, k := range kr.dynamicKinds {
+		if k.resource.Group == gvk.Group && k.kind == gvk.Kind {
+			return &kr.dynamicKinds[i]
+		}
+	}
+	return nil
+}
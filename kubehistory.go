@@ -0,0 +1,158 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"time"
+)
+
+// TimedReplacer is a Replacer that can resolve replacements as they were at a point in time.
+type TimedReplacer interface {
+	Replacer
+	ReplaceAt(s string, t time.Time) string
+}
+
+var _ TimedReplacer = &KubeReplacer{}
+
+// ownership is a period of time an address belonged to an object.
+type ownership struct {
+	owner  string
+	object KubeObject
+	from   time.Time
+	// to is zero while the address is still owned
+	to time.Time
+}
+
+func (o ownership) covers(t time.Time) bool {
+	return (o.from.IsZero() || !t.Before(o.from)) && (o.to.IsZero() || t.Before(o.to))
+}
+
+// claim records that owner took an address at from. Any previous owner is assumed to have released it by then.
+// An address loaded from a cached table for the same object is taken over. Must be called with the lock held.
+func (kr *KubeReplacer) claim(key string, owner string, o KubeObject, from time.Time) {
+	h := kr.history[key]
+	if len(h) > 0 {
+		last := &h[len(h)-1]
+		if last.to.IsZero() && (last.owner == owner || strings.HasPrefix(last.owner, cachedOwner) && last.object == o) {
+			last.owner = owner
+			last.object = o
+			return
+		}
+		if last.to.IsZero() {
+			last.to = from
+			if !from.After(last.from) {
+				last.to = time.Now()
+			}
+		}
+	}
+	if len(h) == 0 {
+		kr.historyKeysChanged = true
+	}
+	kr.history[key] = append(h, ownership{owner: owner, object: o, from: from})
+}
+
+// release records that owner gave up an address at to. Must be called with the lock held.
+func (kr *KubeReplacer) release(key string, owner string, to time.Time) {
+	h := kr.history[key]
+	if len(h) == 0 {
+		return
+	}
+	last := &h[len(h)-1]
+	if last.owner == owner && last.to.IsZero() {
+		last.to = to
+	}
+}
+
+// rebuildHistory prunes history, and updates the marker Replacer and historicNames. Must be called with the lock held.
+func (kr *KubeReplacer) rebuildHistory() {
+	kr.pruneHistory()
+	names := map[string]string{}
+	for _, h := range kr.history {
+		for _, o := range h {
+			if !o.object.highlightOnly {
+				names[kr.renderObject(o.object)] = o.object.Cluster
+			}
+		}
+	}
+	kr.historicNames = names
+	if kr.marker != nil && !kr.historyKeysChanged {
+		return
+	}
+	keys := make([]string, 0, len(kr.history))
+	for k := range kr.history {
+		keys = append(keys, k)
+	}
+	sort.SliceStable(keys, func(i, j int) bool {
+		// Ensure longest IP is first
+		return len(keys[i]) > len(keys[j])
+	})
+	kvlist := make([]string, 0, len(keys)*2)
+	for _, k := range keys {
+		kvlist = append(kvlist, k, "\x00"+k+"\x00")
+	}
+	kr.marker = strings.NewReplacer(kvlist...)
+	kr.historyKeysChanged = false
+}
+
+// pruneHistory drops ownerships which ended more than historyRetention ago. Must be called with the lock held.
+func (kr *KubeReplacer) pruneHistory() {
+	if kr.historyRetention == 0 {
+		return
+	}
+	cutoff := time.Now().Add(-kr.historyRetention)
+	for k, h := range kr.history {
+		kept := h[:0]
+		for _, o := range h {
+			if o.to.IsZero() || o.to.After(cutoff) {
+				kept = append(kept, o)
+			}
+		}
+		if len(kept) == 0 {
+			delete(kr.history, k)
+			kr.historyKeysChanged = true
+			continue
+		}
+		kr.history[k] = kept
+	}
+}
+
+// ReplaceAt replaces addresses with the object that owned them at time t. Addresses with no known owner at t are
+// replaced with their current owner, as in Replace.
+func (kr *KubeReplacer) ReplaceAt(s string, t time.Time) string {
+	if !kr.translateIPs {
+		return s
+	}
+	kr.mu.RLock()
+	defer kr.mu.RUnlock()
+	if kr.marker == nil {
+		return s
+	}
+	marked := kr.marker.Replace(s)
+	if !strings.Contains(marked, "\x00") {
+		return s
+	}
+	parts := strings.Split(marked, "\x00")
+	// Every odd part is an address
+	for i := 1; i < len(parts); i += 2 {
+		parts[i] = kr.resolve(parts[i], t)
+	}
+	return strings.Join(parts, "")
+}
+
+// resolve returns the name of the owner of key at time t. Must be called with the lock held.
+func (kr *KubeReplacer) resolve(key string, t time.Time) string {
+	h := kr.history[key]
+	for i := len(h) - 1; i >= 0; i-- {
+		if !h[i].covers(t) {
+			continue
+		}
+		if h[i].object.highlightOnly {
+			return key
+		}
+		return kr.renderObject(h[i].object)
+	}
+	if r, f := kr.replacements[key]; f {
+		return r
+	}
+	return key
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	utilyaml "k8s.io/apimachinery/pkg/util/yaml"
+	"k8s.io/client-go/kubernetes/scheme"
+)
+
+// kubeSource is a flag that may be set without a value (-k) to watch the current cluster, or with the path of a
+// snapshot to read instead (-k=dump.yaml).
+type kubeSource struct {
+	enabled  bool
+	snapshot string
+}
+
+func (k *kubeSource) String() string {
+	if k.snapshot != "" {
+		return k.snapshot
+	}
+	return strconv.FormatBool(k.enabled)
+}
+
+func (k *kubeSource) Set(v string) error {
+	switch v {
+	case "true":
+		*k = kubeSource{enabled: true}
+	case "false":
+		*k = kubeSource{}
+	default:
+		*k = kubeSource{enabled: true, snapshot: v}
+	}
+	return nil
+}
+
+func (k *kubeSource) IsBoolFlag() bool {
+	return true
+}
+
+// snapshotExtensions are the files read from a snapshot directory, such as a must-gather or bug report.
+var snapshotExtensions = map[string]bool{".yaml": true, ".yml": true, ".json": true}
+
+// loadSnapshot reads objects from a file, or recursively from a directory, of YAML or JSON objects or lists.
+// Files in a directory which are not Kubernetes objects are skipped.
+func (kr *KubeReplacer) loadSnapshot(path string) error {
+	st, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if !st.IsDir() {
+		return kr.loadSnapshotFile(path)
+	}
+	return filepath.WalkDir(path, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || !snapshotExtensions[filepath.Ext(p)] {
+			return nil
+		}
+		err = kr.loadSnapshotFile(p)
+		var pathErr *fs.PathError
+		if errors.As(err, &pathErr) {
+			return err
+		}
+		// Anything else is a file that isn't Kubernetes objects
+		return nil
+	})
+}
+
+// loadSnapshotFile reads each document of a file.
+func (kr *KubeReplacer) loadSnapshotFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	dec := utilyaml.NewYAMLOrJSONDecoder(f, 4096)
+	for {
+		raw := json.RawMessage{}
+		if err := dec.Decode(&raw); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return fmt.Errorf("%v: %w", path, err)
+		}
+		if len(raw) == 0 || string(raw) == "null" {
+			continue
+		}
+		if err := kr.loadSnapshotObject(raw); err != nil {
+			return fmt.Errorf("%v: %w", path, err)
+		}
+	}
+}
+
+// loadSnapshotObject decodes an object, or each item of a list, and handles any of kubeKinds or dynamicKinds.
+// Objects of other kinds are skipped.
+func (kr *KubeReplacer) loadSnapshotObject(raw []byte) error {
+	o, _, err := scheme.Codecs.UniversalDeserializer().Decode(raw, nil, nil)
+	if runtime.IsNotRegisteredError(err) {
+		u := &unstructured.Unstructured{}
+		if err := u.UnmarshalJSON(raw); err != nil {
+			return err
+		}
+		o, err = u, nil
+	}
+	if err != nil {
+		return err
+	}
+	if meta.IsListType(o) {
+		items, err := meta.ExtractList(o)
+		if err != nil {
+			return err
+		}
+		for _, i := range items {
+			if u, ok := i.(*runtime.Unknown); ok {
+				if err := kr.loadSnapshotObject(u.Raw); err != nil {
+					return err
+				}
+				continue
+			}
+			kr.handleObject(i)
+		}
+		return nil
+	}
+	kr.handleObject(o)
+	return nil
+}
+
+// handleObject handles an object of any of kubeKinds or dynamicKinds, if it is in the namespace and matches the
+// selector.
+func (kr *KubeReplacer) handleObject(o runtime.Object) {
+	m, err := meta.Accessor(o)
+	if err != nil {
+		return
+	}
+	if kr.namespace != "" && m.GetNamespace() != "" && m.GetNamespace() != kr.namespace {
+		return
+	}
+	if kr.selector != nil && !kr.selector.Matches(labels.Set(m.GetLabels())) {
+		return
+	}
+	if u, ok := o.(*unstructured.Unstructured); ok {
+		if k := kr.dynamicKindFor(u); k != nil {
+			kr.handle(objectOwner(o), k.extract(o), objectCreated(o))
+		}
+		return
+	}
+	for _, k := range kubeKinds {
+		if reflect.TypeOf(o) == reflect.TypeOf(k.object) {
+			kr.handle(objectOwner(o), k.extract(o), objectCreated(o))
+			return
+		}
+	}
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// cachedOwner prefixes the owner of addresses loaded from a cached table, until informers confirm or replace them.
+const cachedOwner = "cached/"
+
+// KubeTableEntry is a period of time an address belonged to an object, as exported by WriteTable.
+type KubeTableEntry struct {
+	Address     string `json:"address"`
+	Replacement string `json:"replacement"`
+	Cluster     string `json:"cluster,omitempty"`
+	Kind        string `json:"kind"`
+	Name        string `json:"name"`
+	Namespace   string `json:"namespace,omitempty"`
+	// From and To are unset when unknown, or while the address is still owned
+	From *time.Time `json:"from,omitempty"`
+	To   *time.Time `json:"to,omitempty"`
+}
+
+// Table returns every address in the history, ordered by address and then time.
+func (kr *KubeReplacer) Table() []KubeTableEntry {
+	kr.mu.RLock()
+	defer kr.mu.RUnlock()
+	keys := make([]string, 0, len(kr.history))
+	for k := range kr.history {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	res := []KubeTableEntry{}
+	for _, k := range keys {
+		for _, o := range kr.history[k] {
+			if o.object.highlightOnly {
+				continue
+			}
+			res = append(res, KubeTableEntry{
+				Address:     k,
+				Replacement: kr.renderObject(o.object),
+				Cluster:     o.object.Cluster,
+				Kind:        o.object.Kind,
+				Name:        o.object.Name,
+				Namespace:   o.object.Namespace,
+				From:        timePointer(o.from),
+				To:          timePointer(o.to),
+			})
+		}
+	}
+	return res
+}
+
+func timePointer(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
+
+// WriteTable writes the Table as JSON to path, or stdout if path is "-".
+func (kr *KubeReplacer) WriteTable(path string) error {
+	by, err := json.MarshalIndent(kr.Table(), "", "  ")
+	if err != nil {
+		return err
+	}
+	by = append(by, '\n')
+	if path == "-" {
+		_, err := os.Stdout.Write(by)
+		return err
+	}
+	// Write to a temporary file and rename it, so an interrupted write or concurrent writers never leave a
+	// truncated table behind
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(by); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Chmod(0o644); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+// loadTable seeds the replacer from a table written by WriteTable. Addresses still owned in the table are owned by
+// a cachedOwner until an informer claims them, or dropCached is called.
+func (kr *KubeReplacer) loadTable(path string) error {
+	by, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	entries := []KubeTableEntry{}
+	if err := json.Unmarshal(by, &entries); err != nil {
+		return err
+	}
+	kr.mu.Lock()
+	defer kr.mu.Unlock()
+	for _, e := range entries {
+		o := KubeObject{Cluster: e.Cluster, Kind: e.Kind, Name: e.Name, Namespace: e.Namespace}
+		owner := cachedOwner + e.Cluster + "/" + e.Kind + "/" + e.Namespace + "/" + e.Name
+		h := ownership{owner: owner, object: o}
+		if e.From != nil {
+			h.from = *e.From
+		}
+		if e.To != nil {
+			h.to = *e.To
+		}
+		kr.history[e.Address] = append(kr.history[e.Address], h)
+		kr.historyKeysChanged = true
+		if e.To != nil {
+			continue
+		}
+		kr.objects[e.Address] = o
+		kr.owners[e.Address] = owner
+		if kr.claimants[e.Address] == nil {
+			kr.claimants[e.Address] = map[string]KubeObject{}
+		}
+		kr.claimants[e.Address][owner] = o
+		if kr.owned[owner] == nil {
+			kr.owned[owner] = map[string]struct{}{}
+		}
+		kr.owned[owner][e.Address] = struct{}{}
+	}
+	kr.rebuild()
+	return nil
+}
+
+// dropCached removes addresses of a cluster still owned by a cachedOwner, which no informer has claimed.
+func (kr *KubeReplacer) dropCached(cluster string) {
+	kr.mu.Lock()
+	defer kr.mu.Unlock()
+	for owner, keys := range kr.owned {
+		if !strings.HasPrefix(owner, cachedOwner+cluster+"/") {
+			continue
+		}
+		for k := range keys {
+			delete(kr.claimants[k], owner)
+			if len(kr.claimants[k]) == 0 {
+				delete(kr.claimants, k)
+			}
+			if kr.owners[k] != owner {
+				continue
+			}
+			delete(kr.objects, k)
+			delete(kr.owners, k)
+			h := kr.history[k]
+			if len(h) > 0 && h[len(h)-1].owner == owner {
+				h = h[:len(h)-1]
+			}
+			if len(h) == 0 {
+				delete(kr.history, k)
+				kr.historyKeysChanged = true
+			} else {
+				kr.history[k] = h
+			}
+		}
+		delete(kr.owned, owner)
+	}
+	kr.rebuild()
+}
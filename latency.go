@@ -0,0 +1,215 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/howardjohn/log-helper/pkg/color"
+)
+
+type LatencyPair struct {
+	name  string
+	start *regexp.Regexp
+	end   *regexp.Regexp
+}
+
+// LatencyTracker measures the time between paired start and end events, and annotates the end line with it.
+type LatencyTracker struct {
+	gradient color.Gradiant
+	scale    TimeScale
+	pairs    []LatencyPair
+	// pending holds the start time of each open event, by pair and then ID, and order the starts of each pair in the
+	// order they were seen, so the oldest can be evicted
+	pending []map[string]time.Time
+	order   [][]pendingStart
+	// horizon, if set, is how long an event may stay open before its start is forgotten, and maxPending how many
+	// events of a pair may be open at once
+	horizon    time.Duration
+	maxPending int
+	// longest holds the longest latency of each pair so far, which streamed latencies are placed on the gradient by
+	longest []time.Duration
+	// latencies holds the measured latency for each end line
+	latencies map[int]time.Duration
+	names     map[int]string
+	heat      map[int]float64
+}
+
+type pendingStart struct {
+	id string
+	t  time.Time
+}
+
+// maxPendingLatencies is how many events of a pair may be open at once when streaming, after which the oldest are
+// forgotten.
+const maxPendingLatencies = 10000
+
+// NewStreamingLatencyTracker builds a LatencyTracker for lines passed to Observe as they are read. As later latencies
+// are unknown, each is placed on the gradient relative to the longest of its pair so far, and RankScale behaves as
+// LinearScale. Starts which have no end within horizon (if set) are forgotten, as are the oldest once there are
+// maxPendingLatencies, so a long running stream doesn't accumulate them.
+func NewStreamingLatencyTracker(pairs []LatencyPair, gradient color.Gradiant, scale TimeScale, horizon time.Duration) *LatencyTracker {
+	lt := newLatencyTracker(pairs, gradient, scale)
+	lt.horizon = horizon
+	lt.maxPending = maxPendingLatencies
+	return lt
+}
+
+func newLatencyTracker(pairs []LatencyPair, gradient color.Gradiant, scale TimeScale) *LatencyTracker {
+	lt := &LatencyTracker{
+		gradient:  gradient,
+		scale:     scale,
+		pairs:     pairs,
+		pending:   make([]map[string]time.Time, len(pairs)),
+		order:     make([][]pendingStart, len(pairs)),
+		longest:   make([]time.Duration, len(pairs)),
+		latencies: map[int]time.Duration{},
+		names:     map[int]string{},
+		heat:      map[int]float64{},
+	}
+	for i := range pairs {
+		lt.pending[i] = map[string]time.Time{}
+	}
+	return lt
+}
+
+// NewLatencyTracker builds a LatencyTracker for buffered lines, to be annotated with Annotate.
+func NewLatencyTracker(lines []LogLine, pairs []LatencyPair, gradient color.Gradiant, scale TimeScale) *LatencyTracker {
+	lt := newLatencyTracker(pairs, gradient, scale)
+	ends := make([][]int, len(pairs))
+	deltas := make([][]time.Duration, len(pairs))
+	for i, line := range lines {
+		if line.time == nil {
+			continue
+		}
+		p, d, f := lt.match(line.text, line.time.t)
+		if !f {
+			continue
+		}
+		lt.latencies[i] = d
+		lt.names[i] = pairs[p].name
+		ends[p] = append(ends[p], i)
+		deltas[p] = append(deltas[p], d)
+	}
+	// Each pair is placed on the gradient separately, as they may have very different typical latencies
+	for p := range pairs {
+		for n, h := range deltaHeat(deltas[p], scale) {
+			lt.heat[ends[p][n]] = h
+		}
+	}
+	return lt
+}
+
+// match records a line at time t against each pair, and returns the last pair it ended, and the latency.
+func (lt *LatencyTracker) match(line string, t time.Time) (int, time.Duration, bool) {
+	ended, latency, found := 0, time.Duration(0), false
+	for p, pair := range lt.pairs {
+		lt.evict(p, t)
+		pending := lt.pending[p]
+		if id, f := correlationID(pair.end, line); f {
+			if start, f := pending[id]; f {
+				delete(pending, id)
+				ended, latency, found = p, t.Sub(start), true
+			}
+			continue
+		}
+		if id, f := correlationID(pair.start, line); f {
+			pending[id] = t
+			if lt.maxPending > 0 {
+				lt.order[p] = append(lt.order[p], pendingStart{id, t})
+			}
+		}
+	}
+	return ended, latency, found
+}
+
+// evict forgets the oldest starts of pair p which began before the horizon, as of t, or exceed maxPending.
+func (lt *LatencyTracker) evict(p int, t time.Time) {
+	if lt.maxPending == 0 {
+		return
+	}
+	pending, order := lt.pending[p], lt.order[p]
+	for len(order) > 0 {
+		s := order[0]
+		if start, f := pending[s.id]; !f || !start.Equal(s.t) {
+			// Already ended, or restarted later
+			order = order[1:]
+			continue
+		}
+		if len(pending) < lt.maxPending && (lt.horizon == 0 || !s.t.Before(t.Add(-lt.horizon))) {
+			break
+		}
+		delete(pending, s.id)
+		order = order[1:]
+	}
+	// Starts that already ended stay in order until they reach the front; drop them once they dominate
+	if len(order) > 2*len(pending)+64 {
+		live := make([]pendingStart, 0, len(pending))
+		for _, s := range order {
+			if start, f := pending[s.id]; f && start.Equal(s.t) {
+				live = append(live, s)
+			}
+		}
+		order = live
+	}
+	lt.order[p] = order
+}
+
+// correlationID returns the ID captured by r, and whether r matched at all.
+func correlationID(r *regexp.Regexp, line string) (string, bool) {
+	m := r.FindStringSubmatch(line)
+	if m == nil {
+		return "", false
+	}
+	if idx := r.SubexpIndex("id"); idx != -1 {
+		return m[idx], true
+	}
+	if len(m) > 1 {
+		return m[1], true
+	}
+	return "", true
+}
+
+// Annotate appends the latency to line i, if it ended a pair.
+func (lt *LatencyTracker) Annotate(i int, line string) string {
+	d, f := lt.latencies[i]
+	if !f {
+		return line
+	}
+	return lt.annotate(line, lt.names[i], d, lt.heat[i])
+}
+
+// Observe records a streamed line, and returns out with the latency appended if the line ended a pair.
+func (lt *LatencyTracker) Observe(line string, p *ParsedTime, out string) string {
+	if p == nil {
+		return out
+	}
+	pair, d, f := lt.match(line, p.t)
+	if !f {
+		return out
+	}
+	if d > lt.longest[pair] {
+		lt.longest[pair] = d
+	}
+	heat := fraction(float64(d), float64(lt.longest[pair]))
+	if lt.scale == LogScale {
+		heat = fraction(math.Log1p(float64(d)), math.Log1p(float64(lt.longest[pair])))
+	}
+	return lt.annotate(out, lt.pairs[pair].name, d, heat)
+}
+
+func (lt *LatencyTracker) annotate(line string, name string, d time.Duration, heat float64) string {
+	note := fmt.Sprintf("[%v]", d)
+	if name != "" {
+		note = fmt.Sprintf("[%s %v]", name, d)
+	}
+	if flagValues.colorMode != "off" {
+		note = lt.gradient.For(heat).Sprint(note)
+	}
+	if strings.HasSuffix(line, "\n") {
+		return strings.TrimSuffix(line, "\n") + " " + note + "\n"
+	}
+	return line + " " + note
+}
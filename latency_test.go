@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/howardjohn/log-helper/pkg/color"
+)
+
+func TestCorrelationID(t *testing.T) {
+	tests := []struct {
+		regex     string
+		line      string
+		wantID    string
+		wantFound bool
+	}{
+		{`start (?P<id>\d+)`, "start 12", "12", true},
+		{`(\w+) (?P<id>\d+)`, "start 12", "12", true},
+		{`start (\d+)`, "start 12", "12", true},
+		{`start`, "start 12", "", true},
+		{`end (\d+)`, "start 12", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.regex, func(t *testing.T) {
+			id, found := correlationID(regexp.MustCompile(tt.regex), tt.line)
+			if id != tt.wantID || found != tt.wantFound {
+				t.Errorf("correlationID() = %q, %v, want %q, %v", id, found, tt.wantID, tt.wantFound)
+			}
+		})
+	}
+}
+
+func TestLatencyTracker(t *testing.T) {
+	input := `2024-01-01T00:00:00.000000Z start 1
+2024-01-01T00:00:00.100000Z start 2
+2024-01-01T00:00:00.200000Z end 1
+2024-01-01T00:00:00.300000Z end 3
+2024-01-01T00:00:01.100000Z end 2
+2024-01-01T00:00:02.000000Z end 2
+2024-01-01T00:00:02.000000Z open x
+2024-01-01T00:00:02.500000Z close x
+`
+	pairs := []LatencyPair{
+		{name: "req", start: regexp.MustCompile(`start (\d+)`), end: regexp.MustCompile(`end (\d+)`)},
+		{start: regexp.MustCompile(`open (?P<id>\w+)`), end: regexp.MustCompile(`close (?P<id>\w+)`)},
+	}
+	want := []string{
+		"start 1",
+		"start 2",
+		"end 1 [req 200ms]",
+		"end 3",
+		"end 2 [req 1s]",
+		"end 2",
+		"open x",
+		"close x [500ms]",
+	}
+	defer func(mode string) { flagValues.colorMode = mode }(flagValues.colorMode)
+	flagValues.colorMode = "off"
+	records, err := readRecords(0, strings.NewReader(input), NewTimeMatcher(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := flattenRecords(records, []string{""})
+	gradient := color.NewGradiant(color.RGB(0, 0, 0))
+
+	lt := NewLatencyTracker(lines, pairs, gradient, RankScale)
+	buffered := []string{}
+	for i, l := range lines {
+		buffered = append(buffered, strings.TrimPrefix(lt.Annotate(i, l.text), l.text[:28]))
+	}
+	streaming := []string{}
+	st := NewStreamingLatencyTracker(pairs, gradient, LinearScale, time.Minute)
+	for _, l := range lines {
+		streaming = append(streaming, strings.TrimPrefix(st.Observe(l.text, l.time, l.text), l.text[:28]))
+	}
+	for _, got := range [][]string{buffered, streaming} {
+		for i := range got {
+			got[i] = strings.TrimSuffix(got[i], "\n")
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("annotated = %q, want %q", got, want)
+		}
+	}
+}
+
+func TestLatencyTrackerEviction(t *testing.T) {
+	pairs := []LatencyPair{{start: regexp.MustCompile(`start (\d+)`), end: regexp.MustCompile(`end (\d+)`)}}
+	base := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	at := func(s int) *ParsedTime {
+		return &ParsedTime{t: base.Add(time.Duration(s) * time.Second)}
+	}
+	defer func(mode string) { flagValues.colorMode = mode }(flagValues.colorMode)
+	flagValues.colorMode = "off"
+
+	t.Run("horizon", func(t *testing.T) {
+		lt := NewStreamingLatencyTracker(pairs, color.NewGradiant(color.RGB(0, 0, 0)), LinearScale, 10*time.Second)
+		lt.Observe("start 1", at(0), "")
+		lt.Observe("start 2", at(5), "")
+		// Start 1 is past the horizon, so its end is not paired
+		if got := lt.Observe("end 1", at(11), "end 1"); got != "end 1" {
+			t.Errorf("expected start past the horizon to be forgotten, got %q", got)
+		}
+		if got, want := lt.Observe("end 2", at(12), "end 2"), "end 2 [7s]"; got != want {
+			t.Errorf("Observe() = %q, want %q", got, want)
+		}
+		if len(lt.pending[0]) != 0 {
+			t.Errorf("expected no pending starts, got %v", lt.pending[0])
+		}
+	})
+	t.Run("cap", func(t *testing.T) {
+		lt := NewStreamingLatencyTracker(pairs, color.NewGradiant(color.RGB(0, 0, 0)), LinearScale, 0)
+		lt.maxPending = 3
+		for i := 0; i < 1000; i++ {
+			lt.Observe(fmt.Sprintf("start %d", i), at(i), "")
+			if i%2 == 0 {
+				lt.Observe(fmt.Sprintf("end %d", i), at(i), "")
+			}
+		}
+		if len(lt.pending[0]) > 3 {
+			t.Errorf("expected at most 3 pending starts, got %d", len(lt.pending[0]))
+		}
+		if len(lt.order[0]) > 2*3+64 {
+			t.Errorf("expected ended starts to be dropped, got %d", len(lt.order[0]))
+		}
+		// The newest starts are kept
+		if got, want := lt.Observe("end 999", at(1000), "end 999"), "end 999 [1s]"; got != want {
+			t.Errorf("Observe() = %q, want %q", got, want)
+		}
+	})
+}
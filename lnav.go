@@ -0,0 +1,152 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// lnavFormat is the subset of an lnav format definition (https://docs.lnav.org/en/latest/formats.html) we understand.
+type lnavFormat struct {
+	Regex map[string]struct {
+		Pattern string `json:"pattern"`
+	} `json:"regex"`
+	TimestampField  string            `json:"timestamp-field"`
+	TimestampFormat []string          `json:"timestamp-format"`
+	Level           map[string]string `json:"level"`
+}
+
+// lnavLevels are the lnav levels, most severe first, which is the order their matchers are created in.
+var lnavLevels = []string{"fatal", "critical", "error", "warning", "stats", "info", "debug", "debug2", "debug3", "debug4", "debug5", "trace"}
+
+// lnavDefaultLayouts are tried when a format doesn't specify a timestamp-format.
+var lnavDefaultLayouts = []string{
+	"2006-01-02T15:04:05.999999999Z07:00",
+	"2006-01-02T15:04:05.999999999",
+	"2006-01-02 15:04:05.999999999Z07:00",
+	"2006-01-02 15:04:05.999999999",
+	"Jan _2 15:04:05",
+}
+
+// strftimeToLayout maps lnav timestamp-format directives to Go layouts.
+var strftimeToLayout = strings.NewReplacer(
+	"%Y", "2006",
+	"%y", "06",
+	"%m", "01",
+	"%d", "02",
+	"%e", "_2",
+	"%H", "15",
+	"%I", "03",
+	"%M", "04",
+	"%S", "05",
+	"%L", "000",
+	"%f", "000000",
+	"%N", "000000000",
+	"%p", "PM",
+	"%b", "Jan",
+	"%B", "January",
+	"%a", "Mon",
+	"%A", "Monday",
+	"%z", "-0700",
+	"%Z", "MST",
+	"%T", "15:04:05",
+	"%F", "2006-01-02",
+	"%%", "%",
+)
+
+// pcreNamedGroup matches PCRE style named groups, (?<name>...), which we convert to (?P<name>...).
+var pcreNamedGroup = regexp.MustCompile(`\(\?<([a-zA-Z_][a-zA-Z0-9_]*)>`)
+
+// loadLnavFormats reads lnav format files. Each path may be a file, or a directory of *.json files.
+func loadLnavFormats(paths []string) (map[string]lnavFormat, error) {
+	res := map[string]lnavFormat{}
+	for _, p := range paths {
+		files := []string{p}
+		if st, err := os.Stat(p); err == nil && st.IsDir() {
+			files, err = filepath.Glob(filepath.Join(p, "*.json"))
+			if err != nil {
+				return nil, err
+			}
+		}
+		for _, f := range files {
+			by, err := os.ReadFile(f)
+			if err != nil {
+				return nil, err
+			}
+			raw := map[string]json.RawMessage{}
+			if err := json.Unmarshal(by, &raw); err != nil {
+				return nil, fmt.Errorf("%v: %v", f, err)
+			}
+			for name, def := range raw {
+				if strings.HasPrefix(name, "$") {
+					// $schema
+					continue
+				}
+				lf := lnavFormat{}
+				if err := json.Unmarshal(def, &lf); err != nil {
+					return nil, fmt.Errorf("%v: format %v: %v", f, name, err)
+				}
+				res[name] = lf
+			}
+		}
+	}
+	return res, nil
+}
+
+// LogFormats converts the patterns of the format that capture a timestamp into LogFormats.
+// Patterns using PCRE features not supported by Go are skipped.
+func (lf lnavFormat) LogFormats() []LogFormat {
+	field := lf.TimestampField
+	if field == "" {
+		field = "timestamp"
+	}
+	layouts := []string{}
+	for _, f := range lf.TimestampFormat {
+		layouts = append(layouts, strftimeToLayout.Replace(f))
+	}
+	if len(layouts) == 0 {
+		layouts = lnavDefaultLayouts
+	}
+	names := make([]string, 0, len(lf.Regex))
+	for n := range lf.Regex {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	res := []LogFormat{}
+	for _, n := range names {
+		pattern := pcreNamedGroup.ReplaceAllString(lf.Regex[n].Pattern, `(?P<$1>`)
+		r, err := regexp.Compile(pattern)
+		if err != nil {
+			continue
+		}
+		group := r.SubexpIndex(field)
+		if group == -1 {
+			continue
+		}
+		res = append(res, LogFormat{r: r, group: group, layouts: layouts})
+	}
+	return res
+}
+
+// Preset builds a preset highlighting each of the levels of the format. Level patterns using PCRE features not
+// supported by Go are skipped, with a warning.
+func (lf lnavFormat) Preset(name string, colors []string) Config {
+	cfg := Config{Colors: colors}
+	for _, l := range lnavLevels {
+		p, f := lf.Level[l]
+		if !f {
+			continue
+		}
+		p = pcreNamedGroup.ReplaceAllString(p, `(?P<$1>`)
+		if _, err := regexp.Compile(p); err != nil {
+			fmt.Fprintf(os.Stderr, "warning: lnav format %v: skipping %v level pattern: %v\n", name, l, err)
+			continue
+		}
+		cfg.Matchers = append(cfg.Matchers, ConfigMatcher{Regex: p})
+	}
+	return cfg
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestLnavLogFormats(t *testing.T) {
+	lf := lnavFormat{
+		Regex: map[string]struct {
+			Pattern string `json:"pattern"`
+		}{
+			"std":         {Pattern: `^\[(?<timestamp>\d{4}-\d{2}-\d{2} \d{2}:\d{2}:\d{2}\.\d{3})\] (?<level>\w+) (?<body>.*)$`},
+			"lookahead":   {Pattern: `^(?=foo)(?<timestamp>.*)$`},
+			"notimestamp": {Pattern: `^(?<body>.*)$`},
+		},
+		TimestampFormat: []string{"%Y-%m-%d %H:%M:%S.%L"},
+	}
+	formats := lf.LogFormats()
+	if len(formats) != 1 {
+		t.Fatalf("expected only the std pattern to be usable, got %d formats", len(formats))
+	}
+	p, err := NewTimeMatcher(true, formats...).Match("[2024-01-02 03:04:05.678] INFO hello\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p == nil {
+		t.Fatal("expected timestamp")
+	}
+	if want := time.Date(2024, 1, 2, 3, 4, 5, 678000000, time.UTC); !p.t.Equal(want) {
+		t.Errorf("got time %v, want %v", p.t, want)
+	}
+	if p.start != 1 || p.bits != 24 {
+		t.Errorf("got span [%d,%d), want [1,24)", p.start, p.bits)
+	}
+}
+
+func TestLnavPreset(t *testing.T) {
+	lf := lnavFormat{
+		Level: map[string]string{
+			"error":   `(?<level>ERROR)`,
+			"warning": `WARN(?!ING)`,
+			"info":    `INFO`,
+		},
+	}
+	cfg := lf.Preset("test", []string{"red"})
+	got := []string{}
+	for _, m := range cfg.Matchers {
+		got = append(got, m.Regex)
+	}
+	// The lookahead of the warning level is not supported, so it is skipped
+	if want := []string{`(?P<level>ERROR)`, `INFO`}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got matchers %v, want %v", got, want)
+	}
+	// Building matchers must not panic
+	cfg.GetMatchers(nil)
+}
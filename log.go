@@ -1,106 +1,330 @@
 package main
 
 import (
-	"bytes"
 	"fmt"
+	"io"
+	"math"
 	"regexp"
+	"sort"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/howardjohn/log-helper/pkg/color"
 	"github.com/mkmik/argsort"
 )
 
-var knownLogFormats = []*regexp.Regexp{
-	regexp.MustCompile(`^20..-..-..T..:..:..\.......Z\s`),
+// LogFormat describes how to find and parse the timestamp in a line.
+type LogFormat struct {
+	r *regexp.Regexp
+	// group is the subexpression holding the timestamp
+	group int
+	// layouts are tried in order to parse the timestamp
+	layouts []string
 }
 
-func logTimeBuffered(data []byte) error {
-	lines := bytes.Split(data, []byte("\n"))
-	times := make([]*ParsedTime, len(lines))
-	for i, line := range lines {
-		p, err := matchTime(knownLogFormats, line)
-		if err != nil {
-			return err
-		}
-		times[i] = p
+func NewLogFormat(r *regexp.Regexp, layouts ...string) LogFormat {
+	group := r.SubexpIndex("timestamp")
+	if group == -1 {
+		group = 0
 	}
-	lastTime := time.Time{}
-	timeLines := 0
-	for i := range lines {
-		p := times[i]
+	return LogFormat{r: r, group: group, layouts: layouts}
+}
+
+var knownLogFormats = []LogFormat{
+	NewLogFormat(regexp.MustCompile(`^(?P<timestamp>20..-..-..T..:..:..\.......Z)\s`), logTimeLayout+"Z07:00"),
+}
+
+// TimeScale controls how deltas are mapped onto a TimeColorer gradient.
+type TimeScale string
+
+const (
+	// RankScale spreads lines evenly over the gradient, based on their rank among all deltas.
+	RankScale TimeScale = "rank"
+	// LinearScale places lines on the gradient proportionally to their delta.
+	LinearScale TimeScale = "linear"
+	// LogScale places lines on the gradient proportionally to the log of their delta.
+	LogScale TimeScale = "log"
+)
+
+// TimeColorer colors the timestamp of each line based on how long it took since the
+// previous timestamped line, relative to all other lines.
+// When a key is set, lines are instead compared only to previous lines with the same key.
+type TimeColorer struct {
+	times    []*ParsedTime
+	gradient color.Gradiant
+	scale    TimeScale
+	// heat is the position of each line on the gradient, from fastest (0) to slowest (1)
+	heat []float64
+	// prev is the index of the line each delta is measured from, or -1
+	prev []int
+	// outOfOrder marks lines with a timestamp earlier than a previous line
+	outOfOrder      []bool
+	outOfOrderCount int
+}
+
+// outOfOrderMarker is shown before the timestamp of lines that go backwards in time.
+const outOfOrderMarker = "◀ "
+
+var outOfOrderStyle = color.S256(255, 90)
+
+func NewTimeColorer(lines []LogLine, gradient color.Gradiant, scale TimeScale, key *regexp.Regexp) *TimeColorer {
+	tc := &TimeColorer{
+		times:      make([]*ParsedTime, len(lines)),
+		gradient:   gradient,
+		scale:      scale,
+		heat:       make([]float64, len(lines)),
+		prev:       make([]int, len(lines)),
+		outOfOrder: make([]bool, len(lines)),
+	}
+	groups := map[string][]int{}
+	last := map[string]int{}
+	latest := time.Time{}
+	for i, line := range lines {
+		tc.times[i] = line.time
+		tc.prev[i] = -1
+		p := line.time
 		if p == nil {
 			continue
 		}
-		timeLines++
-		p.t.Sub(lastTime)
-		p.delta = p.t.Sub(lastTime)
-		lastTime = p.t
+		k := deltaKey(key, line.text)
+		if l, f := last[k]; f {
+			tc.prev[i] = l
+			p.delta = p.t.Sub(lines[l].time.t)
+		}
+		if p.t.Before(latest) {
+			// Out of order lines are not ranked, and later lines are measured from the last line in order.
+			tc.outOfOrder[i] = true
+			tc.outOfOrderCount++
+			continue
+		}
+		latest = p.t
+		last[k] = i
+		groups[k] = append(groups[k], i)
+	}
+	for _, g := range groups {
+		tc.rank(g)
 	}
+	return tc
+}
+
+// deltaKey returns the key of a line; the first capture group of key if there is one, else the entire match.
+func deltaKey(key *regexp.Regexp, line string) string {
+	if key == nil {
+		return ""
+	}
+	m := key.FindStringSubmatch(line)
+	if len(m) == 0 {
+		return ""
+	}
+	if len(m) > 1 {
+		return m[1]
+	}
+	return m[0]
+}
+
+// rank places each of the given lines on the gradient, relative to each other.
+func (tc *TimeColorer) rank(idx []int) {
+	deltas := make([]time.Duration, 0, len(idx))
+	for _, i := range idx {
+		deltas = append(deltas, tc.times[i].delta)
+	}
+	for n, h := range deltaHeat(deltas, tc.scale) {
+		tc.heat[idx[n]] = h
+	}
+}
 
-	// todo blanks steal spots
-	ranks := argsort.Sort(TimeSlice(times))
-	for i, r := range ranks {
-		if times[r] != nil {
-			times[r].rank = i - (len(ranks) - timeLines)
+// deltaHeat places each delta on a gradient, from fastest (0) to slowest (1).
+func deltaHeat(deltas []time.Duration, scale TimeScale) []float64 {
+	minDelta, maxDelta := time.Duration(0), time.Duration(0)
+	for _, d := range deltas {
+		if d < minDelta {
+			minDelta = d
+		}
+		if d > maxDelta {
+			maxDelta = d
 		}
 	}
-	for i := range lines {
-		p := times[i]
-		line := lines[i]
-		if p == nil {
-			if !flagValues.filterUnmatched {
-				fmt.Println(string(line))
-			}
-			continue
+	ranks := make([]int, len(deltas))
+	for i, r := range argsort.SortSlice(deltas, func(i, j int) bool { return deltas[i] < deltas[j] }) {
+		ranks[r] = i
+	}
+	heat := make([]float64, len(deltas))
+	for i, d := range deltas {
+		switch scale {
+		case LinearScale:
+			heat[i] = fraction(float64(d-minDelta), float64(maxDelta-minDelta))
+		case LogScale:
+			heat[i] = fraction(math.Log1p(float64(d-minDelta)), math.Log1p(float64(maxDelta-minDelta)))
+		default:
+			heat[i] = fraction(float64(ranks[i]), float64(len(deltas)-1))
+		}
+	}
+	return heat
+}
+
+func fraction(n, total float64) float64 {
+	if total <= 0 {
+		return 0
+	}
+	return math.Max(0, math.Min(1, n/total))
+}
+
+// Timestamped returns whether line i had a recognized timestamp.
+func (tc *TimeColorer) Timestamped(i int) bool {
+	return tc.times[i] != nil
+}
+
+// Highlight colors the timestamp of line i, and passes the remainder of the line through rest.
+func (tc *TimeColorer) Highlight(i int, line string, rest func(string) string) string {
+	p := tc.times[i]
+	if p == nil {
+		return rest(line)
+	}
+	ts := line[p.start:p.bits]
+	if tc.outOfOrder[i] {
+		if flagValues.colorMode != "off" {
+			ts = outOfOrderStyle.Sprint(ts)
 		}
+		return outOfOrderMarker + line[:p.start] + ts + rest(line[p.bits:])
+	}
+	if flagValues.colorMode != "off" {
+		ts = tc.gradient.For(tc.heat[i]).Sprint(ts)
+	}
+	return line[:p.start] + ts + rest(line[p.bits:])
+}
 
-		fmt.Printf("%s%s\n", rankToColor(p.rank, len(ranks)).Sprint(string(line[:p.bits])), string(line[p.bits:]))
+// Report writes a summary of any lines that were out of order.
+func (tc *TimeColorer) Report(w io.Writer) {
+	if tc.outOfOrderCount == 0 {
+		return
 	}
+	fmt.Fprintf(w, "warning: %d lines had a timestamp earlier than a previous line (marked with %q)\n", tc.outOfOrderCount, strings.TrimSpace(outOfOrderMarker))
+}
+
+// topContext is the number of lines of context shown around each gap by WriteTop.
+const topContext = 2
 
-	return nil
+// WriteTop writes the n largest deltas, slowest first. Each is shown with the line before the gap, the line after it,
+// and a few lines of context around them.
+func (tc *TimeColorer) WriteTop(w io.Writer, lines []LogLine, n int, rest func(line string, p *ParsedTime) string) {
+	prev := tc.prev
+	gaps := []int{}
+	for i := range tc.times {
+		if prev[i] != -1 {
+			gaps = append(gaps, i)
+		}
+	}
+	sort.SliceStable(gaps, func(i, j int) bool {
+		return tc.times[gaps[i]].delta > tc.times[gaps[j]].delta
+	})
+	width := len(strconv.Itoa(len(lines)))
+	for rank, i := range gaps[:min(n, len(gaps))] {
+		if rank > 0 {
+			fmt.Fprintln(w, "---")
+		}
+		fmt.Fprintf(w, "#%d: %v between line %d and %d\n", rank+1, tc.times[i].delta, prev[i]+1, i+1)
+		writeLines := func(from, to int) {
+			for l := max(0, from); l <= min(len(lines)-1, to); l++ {
+				marker := " "
+				if l == prev[i] || l == i {
+					marker = ">"
+				}
+				p := lines[l].time
+				highlight := func(s string) string {
+					return rest(s, p)
+				}
+				fmt.Fprintf(w, "%s%*d %s%s", marker, width, l+1, lines[l].prefix, tc.Highlight(l, lines[l].text, highlight))
+			}
+		}
+		// With -delta-key, the previous line may be far before; show separate context around each line
+		if prev[i]+topContext+1 >= i-topContext {
+			writeLines(prev[i]-topContext, i+topContext)
+			continue
+		}
+		writeLines(prev[i]-topContext, prev[i]+topContext)
+		fmt.Fprintf(w, " %*s\n", width, "...")
+		writeLines(i-topContext, i+topContext)
+	}
 }
 
-func matchTime(rs []*regexp.Regexp, data []byte) (*ParsedTime, error) {
-	for _, r := range rs {
-		if d := r.Find(data); d != nil {
-			t1, err := time.Parse(
-				`2006-01-02T15:04:05.999999`,
-				string(d)[:len(d)-2])
-			if err != nil {
-				return nil, err
+// matchTime returns the timestamp of the first format that matches and parses. If formats match but none parse, the
+// error of the first is returned.
+func matchTime(formats []LogFormat, data []byte) (*ParsedTime, error) {
+	var firstErr error
+	for _, f := range formats {
+		m := f.r.FindSubmatchIndex(data)
+		if m == nil || m[2*f.group] == -1 {
+			continue
+		}
+		start, end := m[2*f.group], m[2*f.group+1]
+		var err error
+		for _, layout := range f.layouts {
+			var t1 time.Time
+			t1, err = time.Parse(layout, string(data[start:end]))
+			if err == nil {
+				return &ParsedTime{t: t1, start: start, bits: end}, nil
 			}
-			return &ParsedTime{t: t1, bits: len(d) - 1}, nil
+		}
+		if firstErr == nil {
+			firstErr = err
 		}
 	}
-	return nil, nil
+	return nil, firstErr
 }
 
-type ParsedTime struct {
-	t    time.Time
-	bits int
+// TimeMatcher finds timestamps in lines. Unless strict, lines with a timestamp that fails to parse are treated
+// as having no timestamp, and counted so they can be reported at the end.
+type TimeMatcher struct {
+	formats []LogFormat
+	strict  bool
 
-	delta time.Duration
-	rank  int
+	failures     int
+	firstFailure error
 }
 
-type TimeSlice []*ParsedTime
+// NewTimeMatcher builds a TimeMatcher for knownLogFormats, along with any extra formats.
+func NewTimeMatcher(strict bool, extra ...LogFormat) *TimeMatcher {
+	formats := append([]LogFormat{}, knownLogFormats...)
+	return &TimeMatcher{formats: append(formats, extra...), strict: strict}
+}
 
-func (p TimeSlice) Len() int { return len(p) }
-func (p TimeSlice) Less(i, j int) bool {
-	if p[i] == nil {
-		return true
-	}
-	if p[j] == nil {
-		return false
+func (tm *TimeMatcher) Match(line string) (*ParsedTime, error) {
+	// Formats may be anchored to the end of the line, which doesn't include the newline
+	p, err := matchTime(tm.formats, []byte(strings.TrimRight(line, "\r\n")))
+	if err != nil {
+		if tm.strict {
+			return nil, err
+		}
+		if tm.failures == 0 {
+			tm.firstFailure = err
+		}
+		tm.failures++
+		return nil, nil
 	}
-	return p[i].delta < p[j].delta
+	return p, nil
 }
-func (p TimeSlice) Swap(i, j int) { p[i], p[j] = p[j], p[i] }
 
-func rankToColor(rank int, total int) color.Color {
-	position := 1 - float64(rank)/float64(total)
-	if position <= 0.5 {
-		return color.RGB(255, uint8(255*position*2), 0)
+// Report writes a summary of any timestamps that failed to parse.
+func (tm *TimeMatcher) Report(w io.Writer) {
+	if tm.failures == 0 {
+		return
 	}
-	return color.RGB(255-uint8(255*(position-0.5)*2), 255, 0)
+	fmt.Fprintf(w, "warning: treated %d lines with unparseable timestamps as untimestamped, first error: %v\n", tm.failures, tm.firstFailure)
+}
+
+// logTimeLayout is the layout of the default timestamps in knownLogFormats, without the trailing zone.
+const logTimeLayout = `2006-01-02T15:04:05.999999`
+
+func parseLogTime(s string) (time.Time, error) {
+	return time.Parse(logTimeLayout, s)
+}
+
+type ParsedTime struct {
+	t time.Time
+	// start and bits are the offsets of the start and end of the timestamp in the line
+	start int
+	bits  int
+
+	delta time.Duration
 }
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/howardjohn/log-helper/pkg/color"
+)
+
+func TestTimeColorerDeltas(t *testing.T) {
+	input := `2024-01-01T00:00:00.000000Z req=a start
+2024-01-01T00:00:00.100000Z req=b start
+cont
+2024-01-01T00:00:00.200000Z req=a end
+2024-01-01T00:00:05.000000Z req=b end
+`
+	tests := []struct {
+		name     string
+		key      *regexp.Regexp
+		wantPrev []int
+		want     []time.Duration
+	}{
+		{
+			"global",
+			nil,
+			[]int{-1, 0, -1, 1, 3},
+			[]time.Duration{0, 100 * time.Millisecond, 0, 100 * time.Millisecond, 4800 * time.Millisecond},
+		},
+		{
+			"keyed",
+			regexp.MustCompile(`req=(\S+)`),
+			[]int{-1, -1, -1, 0, 1},
+			[]time.Duration{0, 0, 0, 200 * time.Millisecond, 4900 * time.Millisecond},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			records, err := readRecords(0, strings.NewReader(input), NewTimeMatcher(true))
+			if err != nil {
+				t.Fatal(err)
+			}
+			lines := flattenRecords(records, []string{""})
+			tc := NewTimeColorer(lines, color.NewGradiant(color.RGB(0, 0, 0)), RankScale, tt.key)
+			got := []time.Duration{}
+			for _, p := range tc.times {
+				if p == nil {
+					got = append(got, 0)
+					continue
+				}
+				got = append(got, p.delta)
+			}
+			if !reflect.DeepEqual(tc.prev, tt.wantPrev) {
+				t.Errorf("prev = %v, want %v", tc.prev, tt.wantPrev)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("deltas = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTimeColorerOutOfOrder(t *testing.T) {
+	input := `2024-01-01T00:00:00.000000Z a
+2024-01-01T00:00:02.000000Z b
+2024-01-01T00:00:01.000000Z c
+2024-01-01T00:00:02.500000Z d
+`
+	records, err := readRecords(0, strings.NewReader(input), NewTimeMatcher(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tc := NewTimeColorer(flattenRecords(records, []string{""}), color.NewGradiant(color.RGB(0, 0, 0)), RankScale, nil)
+	if want := []bool{false, false, true, false}; !reflect.DeepEqual(tc.outOfOrder, want) {
+		t.Errorf("outOfOrder = %v, want %v", tc.outOfOrder, want)
+	}
+	// d should be measured from b, the last line in order
+	if got, want := tc.times[3].delta, 500*time.Millisecond; got != want {
+		t.Errorf("delta = %v, want %v", got, want)
+	}
+}
+
+func TestTimeColorerWriteTop(t *testing.T) {
+	input := "2024-01-01T00:00:00.000000Z req=a start\n"
+	for i := 1; i <= 10; i++ {
+		input += fmt.Sprintf("2024-01-01T00:00:%02d.000000Z req=b %d\n", i, i)
+	}
+	input += "2024-01-01T00:01:00.000000Z req=a end\n"
+	records, err := readRecords(0, strings.NewReader(input), NewTimeMatcher(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := flattenRecords(records, []string{""})
+	tc := NewTimeColorer(lines, color.NewGradiant(color.RGB(0, 0, 0)), RankScale, regexp.MustCompile(`req=(\S+)`))
+	sb := &strings.Builder{}
+	tc.WriteTop(sb, lines, 1, func(line string, p *ParsedTime) string { return line })
+	shown := []string{}
+	for _, l := range strings.Split(strings.TrimSpace(sb.String()), "\n")[1:] {
+		if strings.TrimSpace(l) == "..." {
+			shown = append(shown, "...")
+			continue
+		}
+		shown = append(shown, strings.Fields(strings.TrimPrefix(l, ">"))[0])
+	}
+	// Context around line 1 and line 12, not every line between them
+	want := []string{"1", "2", "3", "...", "10", "11", "12"}
+	if !reflect.DeepEqual(shown, want) {
+		t.Errorf("shown lines = %v, want %v\n%s", shown, want, sb.String())
+	}
+}
+
+func TestTimeMatcherFallsThrough(t *testing.T) {
+	// The first format matches the line too broadly, and fails to parse it
+	broad := NewLogFormat(regexp.MustCompile(`^(?P<timestamp>\S+ \S+)`), "2006-01-02 15:04:05")
+	slash := NewLogFormat(regexp.MustCompile(`^(?P<timestamp>\S+ \S+)`), "2006/01/02 15:04:05")
+	tests := []struct {
+		line    string
+		want    time.Time
+		wantErr bool
+	}{
+		{"2024-01-02 03:04:05 dashes", time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC), false},
+		{"2024/01/02 03:04:05 slashes", time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC), false},
+		{"not a timestamp", time.Time{}, true},
+		{"short", time.Time{}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.line, func(t *testing.T) {
+			p, err := NewTimeMatcher(true, broad, slash).Match(tt.line)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Match() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			got := time.Time{}
+			if p != nil {
+				got = p.t
+			}
+			if !got.Equal(tt.want) {
+				t.Errorf("Match() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
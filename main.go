@@ -2,11 +2,14 @@ package main
 
 import (
 	"bufio"
+	"errors"
 	"flag"
+	"fmt"
 	"io"
-	"io/ioutil"
 	"os"
+	"regexp"
 	"strings"
+	"time"
 
 	"github.com/mattn/go-isatty"
 )
@@ -15,35 +18,137 @@ type flags struct {
 	colorTest bool
 	runLogs   bool
 
+	histogram      bool
+	sparkline      bool
+	histogramSplit bool
+	bucket         histogramBucket
+	waterfall      string
+
 	caseInsensitive bool
 	filterUnmatched bool
-	kube            bool
-	kubelight       bool
+	kube            kubeSource
+	kubelight       kubeSource
+	kubeTemplate    string
+	kubeDeleted     bool
+	kubeCache       string
+	kubeconfig      string
+	kubeContexts    stringList
+	clusterPrefix   bool
+	namespace       string
+	selector        string
+	kubeTimeout     time.Duration
+	kubeExport      string
 
 	preset    string
 	colorMode string
+	files     stringList
+	since     string
+	until     string
+
+	timezone   string
+	timeFormat string
+	relative   string
+
+	strict   bool
+	top      int
+	deltaKey string
+
+	latency        bool
+	latencyHorizon time.Duration
+
+	bursts      bool
+	burstWindow time.Duration
+	burstFactor float64
+
+	replay       replaySpeed
+	replayMaxGap time.Duration
+}
+
+type stringList []string
+
+func (s *stringList) String() string {
+	return strings.Join(*s, ",")
+}
+
+func (s *stringList) Set(v string) error {
+	*s = append(*s, v)
+	return nil
 }
 
 var flagValues = flags{
-	preset:    "default",
-	colorMode: "on",
+	preset:         "default",
+	colorMode:      "on",
+	replayMaxGap:   5 * time.Second,
+	burstWindow:    time.Second,
+	burstFactor:    3,
+	kubeTimeout:    10 * time.Second,
+	latencyHorizon: 10 * time.Minute,
 }
 
 func init() {
 	flag.BoolVar(&flagValues.colorTest, "test-colors", flagValues.colorTest, "test color support")
 	flag.BoolVar(&flagValues.caseInsensitive, "i", flagValues.caseInsensitive, "case insensitive")
-	flag.BoolVar(&flagValues.kube, "k", flagValues.kube, "replace Kubernetes IPs with names and highlight")
-	flag.BoolVar(&flagValues.kubelight, "kk", flagValues.kubelight, "hightlight Kubernetes IPs with names")
+	flag.Var(&flagValues.kube, "k", "replace Kubernetes IPs with names and highlight. Set to a file or directory (-k=dump.yaml) to read a snapshot, such as kubectl get -o yaml output or a must-gather, instead of the current cluster")
+	flag.Var(&flagValues.kubelight, "kk", "hightlight Kubernetes IPs with names. Accepts a snapshot like -k")
+	flag.StringVar(&flagValues.kubeTemplate, "kube-template", flagValues.kubeTemplate, "template for Kubernetes names, for example {{.Name}}.{{.Namespace}} or {{.Kind}}:{{.Name}} (default qualifies names only when they collide)")
+	flag.StringVar(&flagValues.kubeconfig, "kubeconfig", flagValues.kubeconfig, "kubeconfig file for -k (default KUBECONFIG or ~/.kube/config)")
+	flag.Var(&flagValues.kubeContexts, "context", "kubeconfig context for -k (default current context); may be repeated to resolve addresses from multiple clusters, and named as name=context")
+	flag.BoolVar(&flagValues.clusterPrefix, "cluster-prefix", flagValues.clusterPrefix, "prefix Kubernetes names with their cluster, as cluster/name")
+	flag.StringVar(&flagValues.namespace, "namespace", flagValues.namespace, "only resolve Kubernetes objects in this namespace, and cluster scoped objects (default all namespaces)")
+	flag.StringVar(&flagValues.namespace, "n", flagValues.namespace, "only resolve Kubernetes objects in this namespace (shorthand)")
+	flag.StringVar(&flagValues.selector, "selector", flagValues.selector, "only resolve Kubernetes objects matching this label selector")
+	flag.StringVar(&flagValues.selector, "l", flagValues.selector, "only resolve Kubernetes objects matching this label selector (shorthand)")
+	flag.StringVar(&flagValues.kubeCache, "kube-cache", flagValues.kubeCache, "file to start with a cached table of Kubernetes addresses from while syncing in the background; rewritten once synced")
+	flag.DurationVar(&flagValues.kubeTimeout, "kube-sync-timeout", flagValues.kubeTimeout, "how long to wait for Kubernetes to sync before showing lines that need it (such as with -f or -histogram), or 0 to wait forever; lines are otherwise shown immediately")
+	flag.StringVar(&flagValues.kubeExport, "kube-export", flagValues.kubeExport, "write the table of Kubernetes addresses to a file, or - for stdout, and exit; implies -k")
+	flag.BoolVar(&flagValues.kubeDeleted, "kube-deleted", flagValues.kubeDeleted, "keep Kubernetes addresses of deleted objects, marked (deleted), until they are reused")
 	flag.BoolVar(&flagValues.runLogs, "logs", flagValues.runLogs, "run log highlighter")
 
 	flag.StringVar(&flagValues.colorMode, "color", flagValues.colorMode, "whether color is used (on, off, auto)")
 	flag.StringVar(&flagValues.preset, "preset", flagValues.preset, "preset configuration to use")
 	flag.StringVar(&flagValues.preset, "p", flagValues.preset, "preset configuration to use (shorthand)")
+	flag.Var(&flagValues.files, "f", "file to read instead of stdin; may be repeated to merge files by timestamp")
+	flag.StringVar(&flagValues.since, "since", flagValues.since, "drop lines before this time (timestamp, time of day on or after the first line, +duration from first line, or -duration from last line)")
+	flag.StringVar(&flagValues.until, "until", flagValues.until, "drop lines after this time (timestamp, time of day on or after the first line, +duration from first line, or -duration from last line)")
+	flag.StringVar(&flagValues.timezone, "tz", flagValues.timezone, "rewrite timestamps into this timezone (for example Local or America/Los_Angeles)")
+	flag.StringVar(&flagValues.timeFormat, "time-format", flagValues.timeFormat, "rewrite timestamps using this Go time layout (for example 15:04:05.000)")
+	flag.StringVar(&flagValues.relative, "relative", flagValues.relative, "rewrite timestamps as an offset from an anchor (first, +duration from first line, or a timestamp)")
+	flag.BoolVar(&flagValues.histogram, "histogram", flagValues.histogram, "show a histogram of line rate over time instead of the lines")
+	flag.BoolVar(&flagValues.sparkline, "sparkline", flagValues.sparkline, "show a sparkline of line rate over time instead of the lines")
+	flag.BoolVar(&flagValues.histogramSplit, "split", flagValues.histogramSplit, "split histogram and sparkline by matcher")
+	flag.StringVar(&flagValues.waterfall, "waterfall", flagValues.waterfall, "show a waterfall of lines grouped by the ID captured by this regex instead of the lines")
+	flag.Var(&flagValues.bucket, "bucket", "histogram bucket size (default automatic)")
+	flag.BoolVar(&flagValues.strict, "strict", flagValues.strict, "fail on timestamps that cannot be parsed, rather than treating the line as untimestamped")
+	flag.IntVar(&flagValues.top, "top", flagValues.top, "with -logs, show the N largest gaps between lines instead of every line")
+	flag.StringVar(&flagValues.deltaKey, "delta-key", flagValues.deltaKey, "with -logs, measure each line against the previous line with the same key captured by this regex")
+	flag.BoolVar(&flagValues.latency, "latency", flagValues.latency, "annotate lines ending a start/end pair from the config with the time since the start")
+	flag.DurationVar(&flagValues.latencyHorizon, "latency-horizon", flagValues.latencyHorizon, "with -latency, when streaming, how long a start waits for its end before it is forgotten, or 0 to wait forever (open starts are also capped)")
+	flag.BoolVar(&flagValues.bursts, "bursts", flagValues.bursts, "mark lines in a gutter when the rate of lines for their matcher spikes above its rolling baseline")
+	flag.DurationVar(&flagValues.burstWindow, "burst-window", flagValues.burstWindow, "with -bursts, the window to measure line rate over")
+	flag.Float64Var(&flagValues.burstFactor, "burst-factor", flagValues.burstFactor, "with -bursts, how many times the baseline rate counts as a burst")
+	flag.Var(&flagValues.replay, "replay", "replay lines with their original timing, optionally at a speed multiplier (-replay=10)")
+	flag.DurationVar(&flagValues.replayMaxGap, "replay-max-gap", flagValues.replayMaxGap, "with -replay, the longest time to wait between lines")
 	flag.BoolVar(&flagValues.filterUnmatched, "filter", flagValues.filterUnmatched, "filter unmatched lines")
 }
 
+// validateFlags rejects flags which would otherwise be silently ignored.
+func validateFlags(f flags) error {
+	if f.top > 0 && !f.runLogs {
+		return errors.New("-top requires -logs")
+	}
+	if f.deltaKey != "" && !f.runLogs {
+		return errors.New("-delta-key requires -logs")
+	}
+	return nil
+}
+
 func main() {
 	flag.Parse()
+	if err := validateFlags(flagValues); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		flag.Usage()
+		os.Exit(2)
+	}
 	cfg, err := ReadConfig(flagValues.preset)
 	if err != nil {
 		panic(err.Error())
@@ -61,46 +166,240 @@ func main() {
 		runColorTest()
 		return
 	}
-	if flagValues.runLogs {
-		all, err := ioutil.ReadAll(os.Stdin)
+	staticMatch := cfg.GetMatchers(flag.Args())
+	var matchers MatcherProvider = StaticMatchers{staticMatch}
+
+	var replacer Replacer = strings.NewReplacer()
+	// waitForSync blocks until replacements are ready, which is only worth waiting for when input is buffered
+	waitForSync := func() {}
+	if flagValues.kubeExport != "" && !flagValues.kubelight.enabled {
+		// Exporting needs a table to export, and never reads input
+		flagValues.kube.enabled = true
+	}
+	if flagValues.kube.enabled || flagValues.kubelight.enabled {
+		snapshot := flagValues.kube.snapshot
+		if flagValues.kubelight.enabled {
+			snapshot = flagValues.kubelight.snapshot
+		}
+		resources, err := cfg.GetKubeResources()
 		if err != nil {
 			panic(err.Error())
 		}
-		if err := logTimeBuffered(all); err != nil {
+		kr, err := NewKubeReplacer(KubeOptions{
+			TranslateIPs:  !flagValues.kubelight.enabled,
+			NameTemplate:  flagValues.kubeTemplate,
+			MarkDeleted:   flagValues.kubeDeleted,
+			Snapshot:      snapshot,
+			Kubeconfig:    flagValues.kubeconfig,
+			Contexts:      flagValues.kubeContexts,
+			ClusterPrefix: flagValues.clusterPrefix,
+			Namespace:     flagValues.namespace,
+			Selector:      flagValues.selector,
+			Resources:     resources,
+			Cache:         flagValues.kubeCache,
+			SyncTimeout:   flagValues.kubeTimeout,
+		})
+		if err != nil {
+			panic(err.Error())
+		}
+		if flagValues.kubeExport != "" {
+			kr.WaitForSync()
+			if err := kr.WriteTable(flagValues.kubeExport); err != nil {
+				panic(err.Error())
+			}
+			return
+		}
+		replacer = kr
+		waitForSync = kr.WaitForSync
+		matchers = NewKubeMatcher(staticMatch, kr, ParseColors(cfg.Colors))
+	}
+
+	h := Highlighter{replacer: replacer, matchers: matchers}
+	w := io.MultiWriter(os.Stdout)
+	since, err := ParseTimeBound(flagValues.since)
+	if err != nil {
+		panic(err.Error())
+	}
+	until, err := ParseTimeBound(flagValues.until)
+	if err != nil {
+		panic(err.Error())
+	}
+	tm := NewTimeMatcher(flagValues.strict, cfg.LogFormats...)
+	defer tm.Report(os.Stderr)
+	tr, err := NewTimeRewriter(flagValues.timezone, flagValues.timeFormat, flagValues.relative)
+	if err != nil {
+		panic(err.Error())
+	}
+	var rp *Replayer
+	if flagValues.replay > 0 {
+		rp = NewReplayer(float64(flagValues.replay), flagValues.replayMaxGap)
+	}
+	var bd *BurstDetector
+	if flagValues.bursts {
+		bd = NewBurstDetector(staticMatch, flagValues.burstWindow, flagValues.burstFactor)
+	}
+	summarize := flagValues.histogram || flagValues.sparkline || flagValues.waterfall != ""
+	buffered := flagValues.runLogs || summarize || len(flagValues.files) > 0 || since.set || until.set
+	_, timedReplacer := replacer.(TimedReplacer)
+	if !buffered {
+		var lt *LatencyTracker
+		if flagValues.latency {
+			gradient, scale, err := cfg.GetTimeGradient()
+			if err != nil {
+				panic(err.Error())
+			}
+			lt = NewStreamingLatencyTracker(cfg.GetLatencyPairs(), gradient, scale, flagValues.latencyHorizon)
+		}
+		// last is the time of the most recent timestamped line, which continuation lines are assumed to share
+		var last *ParsedTime
+		if err := forEachLine(os.Stdin, func(line string) error {
+			gutter := ""
+			var p *ParsedTime
+			text := line
+			if tr != nil || rp != nil || bd != nil || lt != nil || timedReplacer {
+				var err error
+				p, err = tm.Match(line)
+				if err != nil {
+					return err
+				}
+				if p != nil {
+					last = p
+				}
+				if bd != nil {
+					gutter = bd.Observe(line, p)
+				}
+				if tr != nil {
+					line = tr.Rewrite(line, p)
+				}
+				if rp != nil {
+					rp.Wait(p)
+				}
+			}
+			o := h.HighlightAt(line, last)
+			if lt != nil {
+				o = lt.Observe(text, p, o)
+			}
+			_, err := w.Write([]byte(gutter + o))
+			return err
+		}); err != nil {
 			panic(err.Error())
 		}
 		return
 	}
-	staticMatch := cfg.GetMatchers(flag.Args())
-	var matchers MatcherProvider = StaticMatchers{staticMatch}
 
-	var replacer Replacer = strings.NewReplacer()
-	if flagValues.kube || flagValues.kubelight {
-		kr, err := NewKubeReplacer(!flagValues.kubelight)
+	files := flagValues.files
+	if len(files) == 0 {
+		files = []string{"-"}
+	}
+	records, err := readMergedFiles(files, tm)
+	if err != nil {
+		panic(err.Error())
+	}
+	waitForSync()
+	records = filterTimeRange(records, since, until)
+	if tr != nil {
+		rewriteTimes(records, tr)
+	}
+	if summarize {
+		var split []*Matcher
+		if flagValues.histogramSplit {
+			split = staticMatch
+		}
+		loc := time.UTC
+		if tr != nil {
+			loc = tr.location
+		}
+		if flagValues.waterfall != "" {
+			m := NewMatcher(compileRegex(flagValues.waterfall), ParseColors(cfg.Colors)[0])
+			NewWaterfall(records, m).Write(w, loc)
+		} else if flagValues.sparkline {
+			hist, err := NewHistogram(records, split, time.Duration(flagValues.bucket), 2*histogramWidth)
+			if err != nil {
+				panic(err.Error())
+			}
+			hist.WriteSparklines(w, loc)
+		} else {
+			hist, err := NewHistogram(records, split, time.Duration(flagValues.bucket), histogramWidth/2)
+			if err != nil {
+				panic(err.Error())
+			}
+			hist.WriteBars(w, loc)
+		}
+		return
+	}
+	lines := flattenRecords(records, sourcePrefixes(files, ParseColors(cfg.Colors)))
+	var tc *TimeColorer
+	if flagValues.runLogs {
+		gradient, scale, err := cfg.GetTimeGradient()
 		if err != nil {
 			panic(err.Error())
 		}
-		replacer = kr
-		matchers = NewKubeMatcher(staticMatch, kr, ParseColors(cfg.Colors))
+		var key *regexp.Regexp
+		if flagValues.deltaKey != "" {
+			key = compileRegex(flagValues.deltaKey)
+		}
+		tc = NewTimeColorer(lines, gradient, scale, key)
+		defer tc.Report(os.Stderr)
+		if flagValues.top > 0 {
+			tc.WriteTop(w, lines, flagValues.top, h.HighlightAt)
+			return
+		}
+	}
+	var lt *LatencyTracker
+	if flagValues.latency {
+		gradient, scale, err := cfg.GetTimeGradient()
+		if err != nil {
+			panic(err.Error())
+		}
+		lt = NewLatencyTracker(lines, cfg.GetLatencyPairs(), gradient, scale)
 	}
+	var last *ParsedTime
+	for i, line := range lines {
+		if line.time != nil {
+			last = line.time
+		}
+		rest := func(s string) string {
+			return h.HighlightAt(s, last)
+		}
+		o := ""
+		if tc != nil {
+			if flagValues.filterUnmatched && !tc.Timestamped(i) {
+				continue
+			}
+			o = tc.Highlight(i, line.text, rest)
+		} else {
+			o = rest(line.text)
+		}
+		if lt != nil {
+			o = lt.Annotate(i, o)
+		}
+		gutter := ""
+		if bd != nil {
+			gutter = bd.Observe(line.text, line.time)
+		}
+		if rp != nil {
+			rp.Wait(line.time)
+		}
+		w.Write([]byte(gutter + line.prefix + o))
+	}
+}
 
-	w := io.MultiWriter(os.Stdout)
-	r := bufio.NewReader(os.Stdin)
+func forEachLine(in io.Reader, f func(line string) error) error {
+	r := bufio.NewReader(in)
 	for {
 		line, err := r.ReadString('\n')
 		// Last line may return EOF and some data
 		if len(line) == 0 && err == io.EOF {
-			break
+			return nil
 		}
 		if err != nil && err != io.EOF {
-			panic(err.Error())
+			return err
+		}
+		if ferr := f(line); ferr != nil {
+			return ferr
 		}
-		r := replacer.Replace(line)
-		m := FindAllMatches(matchers.GetMatchers(), r)
-		o := getLine(m, r)
-		w.Write([]byte(o))
 		if err == io.EOF {
-			break
+			return nil
 		}
 	}
 }
@@ -98,3 +98,24 @@ func TestOverlaps(t *testing.T) {
 		})
 	}
 }
+
+func TestValidateFlags(t *testing.T) {
+	tests := []struct {
+		name    string
+		flags   flags
+		wantErr bool
+	}{
+		{"defaults", flags{}, false},
+		{"top with logs", flags{top: 5, runLogs: true}, false},
+		{"top without logs", flags{top: 5}, true},
+		{"delta key with logs", flags{deltaKey: `id=(\S+)`, runLogs: true}, false},
+		{"delta key without logs", flags{deltaKey: `id=(\S+)`}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := validateFlags(tt.flags); (err != nil) != tt.wantErr {
+				t.Errorf("validateFlags() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/howardjohn/log-helper/pkg/color"
+)
+
+// LogRecord is a timestamped line, along with any untimestamped continuation lines that follow it.
+type LogRecord struct {
+	source int
+	time   *ParsedTime
+	lines  []string
+}
+
+func readRecords(source int, in io.Reader, tm *TimeMatcher) ([]LogRecord, error) {
+	records := []LogRecord{}
+	err := forEachLine(in, func(line string) error {
+		p, err := tm.Match(line)
+		if err != nil {
+			return err
+		}
+		if p != nil || len(records) == 0 {
+			records = append(records, LogRecord{source: source, time: p})
+		}
+		cur := &records[len(records)-1]
+		cur.lines = append(cur.lines, line)
+		return nil
+	})
+	return records, err
+}
+
+// mergeRecords combines the records from each source into a single timeline, ordered by timestamp.
+// Each source is assumed to already be in order, and its order is preserved. Records without a timestamp
+// (leading lines of a file) are emitted as soon as they are reached. Ties keep source order.
+func mergeRecords(sources [][]LogRecord) []LogRecord {
+	res := []LogRecord{}
+	heads := make([]int, len(sources))
+	for {
+		next := -1
+		for s, h := range heads {
+			if h >= len(sources[s]) {
+				continue
+			}
+			if next == -1 || recordBefore(sources[s][h], sources[next][heads[next]]) {
+				next = s
+			}
+		}
+		if next == -1 {
+			return res
+		}
+		res = append(res, sources[next][heads[next]])
+		heads[next]++
+	}
+}
+
+func recordBefore(a, b LogRecord) bool {
+	if a.time == nil {
+		return b.time != nil
+	}
+	if b.time == nil {
+		return false
+	}
+	return a.time.t.Before(b.time.t)
+}
+
+// readMergedFiles reads all files, returning their records merged into a single timeline.
+func readMergedFiles(files []string, tm *TimeMatcher) ([]LogRecord, error) {
+	sources := make([][]LogRecord, 0, len(files))
+	for i, f := range files {
+		records, err := readFile(i, f, tm)
+		if err != nil {
+			return nil, err
+		}
+		sources = append(sources, records)
+	}
+	return mergeRecords(sources), nil
+}
+
+// sourcePrefixes returns a colored prefix for each file, indicating which file a line came from.
+// When there is only a single file, no prefix is needed.
+func sourcePrefixes(files []string, colors []color.Color) []string {
+	prefixes := make([]string, len(files))
+	if len(files) == 1 {
+		return prefixes
+	}
+	width := 0
+	for _, f := range files {
+		width = max(width, len(filepath.Base(f)))
+	}
+	for i, f := range files {
+		p := fmt.Sprintf("%-*s ", width, filepath.Base(f))
+		if flagValues.colorMode != "off" {
+			p = ExtrapolateColorList(colors, i, len(files)).Sprint(p)
+		}
+		prefixes[i] = p
+	}
+	return prefixes
+}
+
+// LogLine is a single line of output, with the prefix indicating its source.
+type LogLine struct {
+	text   string
+	prefix string
+	// time is the timestamp of the line, or nil for lines without a timestamp
+	time *ParsedTime
+}
+
+// flattenRecords returns the lines of all records.
+func flattenRecords(records []LogRecord, prefixes []string) []LogLine {
+	lines := []LogLine{}
+	for _, r := range records {
+		for i, l := range r.lines {
+			if !strings.HasSuffix(l, "\n") {
+				// Last line of a file may be unterminated, but may no longer be last once merged
+				l += "\n"
+			}
+			line := LogLine{text: l, prefix: prefixes[r.source]}
+			if i == 0 {
+				line.time = r.time
+			}
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
+
+func readFile(source int, name string, tm *TimeMatcher) ([]LogRecord, error) {
+	if name == "-" {
+		return readRecords(source, os.Stdin, tm)
+	}
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return readRecords(source, f, tm)
+}
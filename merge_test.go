@@ -0,0 +1,85 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestMergeRecords(t *testing.T) {
+	tests := []struct {
+		name    string
+		sources []string
+		want    []string
+	}{
+		{
+			"interleave",
+			[]string{
+				"2024-01-01T00:00:00.000000Z a1\n2024-01-01T00:00:02.000000Z a2\n",
+				"2024-01-01T00:00:01.000000Z b1\n2024-01-01T00:00:03.000000Z b2\n",
+			},
+			[]string{"a1", "b1", "a2", "b2"},
+		},
+		{
+			"continuation lines follow parent",
+			[]string{
+				"2024-01-01T00:00:00.000000Z a1\ncont a1\n2024-01-01T00:00:02.000000Z a2\n",
+				"2024-01-01T00:00:01.000000Z b1\ncont b1\n",
+			},
+			[]string{"a1", "cont a1", "b1", "cont b1", "a2"},
+		},
+		{
+			"leading untimestamped lines first",
+			[]string{
+				"2024-01-01T00:00:00.000000Z a1\n",
+				"header b\n2024-01-01T00:00:01.000000Z b1\n",
+			},
+			[]string{"header b", "a1", "b1"},
+		},
+		{
+			"source order preserved",
+			[]string{
+				"2024-01-01T00:00:05.000000Z a1\n2024-01-01T00:00:00.000000Z a2\n",
+			},
+			[]string{"a1", "a2"},
+		},
+		{
+			"ties keep source order",
+			[]string{
+				"2024-01-01T00:00:00.000000Z a1\n",
+				"2024-01-01T00:00:00.000000Z b1\n",
+			},
+			[]string{"a1", "b1"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sources := [][]LogRecord{}
+			for i, s := range tt.sources {
+				r, err := readRecords(i, strings.NewReader(s), NewTimeMatcher(true))
+				if err != nil {
+					t.Fatal(err)
+				}
+				sources = append(sources, r)
+			}
+			got := recordLines(mergeRecords(sources))
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("mergeRecords() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// recordLines returns the lines of each record, with timestamps and whitespace removed.
+func recordLines(records []LogRecord) []string {
+	res := []string{}
+	for _, r := range records {
+		for i, l := range r.lines {
+			if i == 0 && r.time != nil {
+				l = l[r.time.bits:]
+			}
+			res = append(res, strings.TrimSpace(l))
+		}
+	}
+	return res
+}
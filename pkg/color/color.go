@@ -48,7 +48,7 @@ func (g Gradiant) For(n float64) Color {
 	if n < 0 || n > 1 {
 		panic(fmt.Sprintf("must be [0,1], got %v", n))
 	}
-	if n == 1 {
+	if n == 1 || len(g.colors) == 1 {
 		return g.colors[len(g.colors)-1]
 	}
 	if n == 0 {
@@ -66,7 +66,7 @@ func (g Gradiant) For(n float64) Color {
 		uint8(float64(basec[0])+(float64(nextc[0])-float64(basec[0]))*(distanceBetweenColors)),
 		uint8(float64(basec[1])+(float64(nextc[1])-float64(basec[1]))*(distanceBetweenColors)),
 		uint8(float64(basec[2])+(float64(nextc[2])-float64(basec[2]))*(distanceBetweenColors)),
-		!g.colors[0].IsEmpty(),
+		basec[3] == color.AsBg,
 	)
 }
 
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// replaySpeed is a flag that may be set without a value (-replay) to replay in real time, or with a speed
+// multiplier (-replay=10).
+type replaySpeed float64
+
+func (r *replaySpeed) String() string {
+	return strconv.FormatFloat(float64(*r), 'g', -1, 64)
+}
+
+func (r *replaySpeed) Set(v string) error {
+	switch v {
+	case "true":
+		*r = 1
+		return nil
+	case "false":
+		*r = 0
+		return nil
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		return err
+	}
+	if f <= 0 {
+		return fmt.Errorf("replay speed must be positive, got %v", f)
+	}
+	*r = replaySpeed(f)
+	return nil
+}
+
+func (r *replaySpeed) IsBoolFlag() bool {
+	return true
+}
+
+// Replayer delays lines to reproduce the original timing between them.
+type Replayer struct {
+	speed  float64
+	maxGap time.Duration
+	last   time.Time
+	// sleep is time.Sleep, unless replaced by tests
+	sleep func(time.Duration)
+}
+
+func NewReplayer(speed float64, maxGap time.Duration) *Replayer {
+	return &Replayer{speed: speed, maxGap: maxGap, sleep: time.Sleep}
+}
+
+// Wait sleeps for the time between the previous timestamped line and this one, scaled by the speed and capped at
+// maxGap. Lines without a timestamp, or that go backwards in time, are not delayed.
+func (r *Replayer) Wait(p *ParsedTime) {
+	if p == nil {
+		return
+	}
+	if !r.last.IsZero() && p.t.After(r.last) {
+		d := time.Duration(float64(p.t.Sub(r.last)) / r.speed)
+		if r.maxGap > 0 && d > r.maxGap {
+			d = r.maxGap
+		}
+		r.sleep(d)
+	}
+	if p.t.After(r.last) {
+		r.last = p.t
+	}
+}
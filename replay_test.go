@@ -0,0 +1,71 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestReplaySpeed(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    replaySpeed
+		wantErr bool
+	}{
+		{"true", 1, false},
+		{"false", 0, false},
+		{"10", 10, false},
+		{"0.5", 0.5, false},
+		{"0", 0, true},
+		{"-2", 0, true},
+		{"fast", 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			var r replaySpeed
+			err := r.Set(tt.value)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Set() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if r != tt.want {
+				t.Errorf("Set() = %v, want %v", r, tt.want)
+			}
+		})
+	}
+}
+
+func TestReplayerWait(t *testing.T) {
+	at := func(s float64) *ParsedTime {
+		return &ParsedTime{t: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC).Add(time.Duration(s * float64(time.Second)))}
+	}
+	tests := []struct {
+		name   string
+		speed  float64
+		maxGap time.Duration
+		times  []*ParsedTime
+		want   []time.Duration
+	}{
+		{"real time", 1, 0, []*ParsedTime{at(0), at(1), at(3)}, []time.Duration{time.Second, 2 * time.Second}},
+		{"faster", 4, 0, []*ParsedTime{at(0), at(1), at(3)}, []time.Duration{250 * time.Millisecond, 500 * time.Millisecond}},
+		{"capped", 1, 5 * time.Second, []*ParsedTime{at(0), at(1), at(60)}, []time.Duration{time.Second, 5 * time.Second}},
+		{"no timestamp", 1, 0, []*ParsedTime{at(0), nil, at(2)}, []time.Duration{2 * time.Second}},
+		// Going backwards doesn't wait, and later lines are timed from the latest line seen
+		{"backwards", 1, 0, []*ParsedTime{at(0), at(5), at(2), at(6)}, []time.Duration{5 * time.Second, time.Second}},
+		{"same time", 1, 0, []*ParsedTime{at(1), at(1)}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := NewReplayer(tt.speed, tt.maxGap)
+			var got []time.Duration
+			r.sleep = func(d time.Duration) {
+				got = append(got, d)
+			}
+			for _, p := range tt.times {
+				r.Wait(p)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("slept %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
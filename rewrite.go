@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// defaultRewriteLayout matches the default format of knownLogFormats, but with the zone offset of the chosen timezone.
+const defaultRewriteLayout = "2006-01-02T15:04:05.000000Z07:00"
+
+// TimeRewriter replaces the timestamp of each line, either converting it to another timezone and layout, or to an
+// offset relative to an anchor time.
+type TimeRewriter struct {
+	location *time.Location
+	layout   string
+
+	relative bool
+	anchor   TimeBound
+	// anchorTime is resolved from anchor once the first timestamp is seen
+	anchorTime time.Time
+}
+
+// NewTimeRewriter builds a TimeRewriter. relativeTo may be "first", or a TimeBound relative to the first line.
+// If no rewriting is configured, nil is returned.
+func NewTimeRewriter(tz string, layout string, relativeTo string) (*TimeRewriter, error) {
+	if tz == "" && layout == "" && relativeTo == "" {
+		return nil, nil
+	}
+	tr := &TimeRewriter{
+		location: time.UTC,
+		layout:   defaultRewriteLayout,
+	}
+	if tz != "" {
+		loc, err := time.LoadLocation(tz)
+		if err != nil {
+			return nil, err
+		}
+		tr.location = loc
+	}
+	if layout != "" {
+		tr.layout = layout
+	}
+	if relativeTo != "" {
+		if relativeTo == "first" {
+			relativeTo = "+0s"
+		}
+		b, err := ParseTimeBound(relativeTo)
+		if err != nil {
+			return nil, err
+		}
+		if b.offset < 0 {
+			return nil, fmt.Errorf("relative anchor %q must be absolute or relative to the first line", relativeTo)
+		}
+		tr.relative = true
+		tr.anchor = b
+	}
+	return tr, nil
+}
+
+// Rewrite replaces the timestamp of line, updating p to cover the new timestamp.
+func (tr *TimeRewriter) Rewrite(line string, p *ParsedTime) string {
+	if p == nil {
+		return line
+	}
+	ts := tr.format(p.t)
+	rest := line[p.bits:]
+	p.bits = p.start + len(ts)
+	return line[:p.start] + ts + rest
+}
+
+func (tr *TimeRewriter) format(t time.Time) string {
+	if !tr.relative {
+		return t.In(tr.location).Format(tr.layout)
+	}
+	if tr.anchorTime.IsZero() {
+		tr.anchorTime = tr.anchor.Resolve(t, t)
+	}
+	return fmt.Sprintf("T%+.6fs", t.Sub(tr.anchorTime).Seconds())
+}
+
+// rewriteTimes applies the TimeRewriter to the first line of each record.
+func rewriteTimes(records []LogRecord, tr *TimeRewriter) {
+	for _, r := range records {
+		if r.time == nil {
+			continue
+		}
+		r.lines[0] = tr.Rewrite(r.lines[0], r.time)
+	}
+}
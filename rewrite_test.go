@@ -0,0 +1,66 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestTimeRewriter(t *testing.T) {
+	input := []string{
+		"2024-01-01T00:00:01.000000Z first",
+		"continued",
+		"2024-01-01T00:00:02.500000Z second",
+	}
+	tests := []struct {
+		name     string
+		tz       string
+		layout   string
+		relative string
+		want     []string
+		wantErr  bool
+	}{
+		{name: "none", want: nil},
+		{name: "timezone", tz: "Asia/Tokyo", want: []string{
+			"2024-01-01T09:00:01.000000+09:00 first",
+			"continued",
+			"2024-01-01T09:00:02.500000+09:00 second",
+		}},
+		{name: "layout", layout: "15:04:05", want: []string{"00:00:01 first", "continued", "00:00:02 second"}},
+		{name: "first", relative: "first", want: []string{"T+0.000000s first", "continued", "T+1.500000s second"}},
+		{name: "offset", relative: "+2s", want: []string{"T-2.000000s first", "continued", "T-0.500000s second"}},
+		{name: "absolute", relative: "2024-01-01T00:00:00Z", want: []string{"T+1.000000s first", "continued", "T+2.500000s second"}},
+		{name: "from last", relative: "-1s", wantErr: true},
+		{name: "bad timezone", tz: "Not/AZone", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tr, err := NewTimeRewriter(tt.tz, tt.layout, tt.relative)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("NewTimeRewriter() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tr == nil {
+				if tt.want != nil {
+					t.Fatalf("NewTimeRewriter() = nil")
+				}
+				return
+			}
+			tm := NewTimeMatcher(true)
+			got := []string{}
+			for _, line := range input {
+				p, err := tm.Match(line)
+				if err != nil {
+					t.Fatal(err)
+				}
+				line = tr.Rewrite(line, p)
+				if p != nil && !strings.HasPrefix(line[p.bits:], " ") {
+					t.Errorf("timestamp end not updated for %q", line)
+				}
+				got = append(got, line)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Rewrite() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// TimeBound is one end of a time range. It is either an absolute time, a time of day, or an offset relative to the
+// first (+5m) or last (-5m) timestamp in the input. A time of day refers to its first occurrence at or after the first
+// timestamp, so ranges work across midnight.
+type TimeBound struct {
+	set       bool
+	absolute  time.Time
+	timeOfDay bool
+	offset    time.Duration
+	fromFirst bool
+}
+
+func ParseTimeBound(s string) (TimeBound, error) {
+	if s == "" {
+		return TimeBound{}, nil
+	}
+	if strings.HasPrefix(s, "+") || strings.HasPrefix(s, "-") {
+		d, err := time.ParseDuration(s[1:])
+		if err != nil {
+			return TimeBound{}, err
+		}
+		if s[0] == '+' {
+			return TimeBound{set: true, offset: d, fromFirst: true}, nil
+		}
+		return TimeBound{set: true, offset: -d}, nil
+	}
+	if t, err := time.Parse(time.RFC3339Nano, s); err == nil {
+		return TimeBound{set: true, absolute: t}, nil
+	}
+	if t, err := parseLogTime(strings.TrimSuffix(s, "Z")); err == nil {
+		return TimeBound{set: true, absolute: t}, nil
+	}
+	for _, layout := range []string{"15:04:05.999999", "15:04"} {
+		if t, err := time.Parse(layout, s); err == nil {
+			return TimeBound{set: true, absolute: t, timeOfDay: true}, nil
+		}
+	}
+	return TimeBound{}, fmt.Errorf("invalid time %q: expected a timestamp, a time of day, or a duration like +5m or -5m", s)
+}
+
+// Resolve returns the time the bound refers to, given the first and last timestamps of the input.
+func (b TimeBound) Resolve(first, last time.Time) time.Time {
+	switch {
+	case b.timeOfDay:
+		y, m, d := first.Date()
+		t := time.Date(y, m, d, b.absolute.Hour(), b.absolute.Minute(), b.absolute.Second(), b.absolute.Nanosecond(), first.Location())
+		if t.Before(first) {
+			t = t.AddDate(0, 0, 1)
+		}
+		return t
+	case !b.absolute.IsZero():
+		return b.absolute
+	case b.fromFirst:
+		return first.Add(b.offset)
+	default:
+		return last.Add(b.offset)
+	}
+}
+
+// filterTimeRange drops all records outside of [since, until]. Continuation lines are part of their record, so
+// follow the fate of their parent line. Leading lines without any timestamp are treated as occurring before the
+// first timestamp.
+func filterTimeRange(records []LogRecord, since, until TimeBound) []LogRecord {
+	if !since.set && !until.set {
+		return records
+	}
+	first, last := time.Time{}, time.Time{}
+	for _, r := range records {
+		if r.time == nil {
+			continue
+		}
+		if first.IsZero() || r.time.t.Before(first) {
+			first = r.time.t
+		}
+		if last.IsZero() || r.time.t.After(last) {
+			last = r.time.t
+		}
+	}
+	start, end := since.Resolve(first, last), until.Resolve(first, last)
+	res := make([]LogRecord, 0, len(records))
+	for _, r := range records {
+		if r.time == nil {
+			if !since.set {
+				res = append(res, r)
+			}
+			continue
+		}
+		if since.set && r.time.t.Before(start) {
+			continue
+		}
+		if until.set && r.time.t.After(end) {
+			continue
+		}
+		res = append(res, r)
+	}
+	return res
+}
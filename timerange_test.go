@@ -0,0 +1,88 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFilterTimeRange(t *testing.T) {
+	input := `header
+2024-01-01T00:00:00.000000Z a
+2024-01-01T00:00:01.000000Z b
+cont b
+2024-01-01T00:00:02.000000Z c
+2024-01-01T00:00:03.000000Z d
+`
+	tests := []struct {
+		since string
+		until string
+		want  []string
+	}{
+		{"", "", []string{"header", "a", "b", "cont b", "c", "d"}},
+		{"+1s", "", []string{"b", "cont b", "c", "d"}},
+		{"-1s", "", []string{"c", "d"}},
+		{"", "-2s", []string{"header", "a", "b", "cont b"}},
+		{"+1s", "-1s", []string{"b", "cont b", "c"}},
+		{"00:00:01", "2024-01-01T00:00:01Z", []string{"b", "cont b"}},
+		{"2024-01-01T00:00:02.000000Z", "", []string{"c", "d"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.since+"/"+tt.until, func(t *testing.T) {
+			since, err := ParseTimeBound(tt.since)
+			if err != nil {
+				t.Fatal(err)
+			}
+			until, err := ParseTimeBound(tt.until)
+			if err != nil {
+				t.Fatal(err)
+			}
+			records, err := readRecords(0, strings.NewReader(input), NewTimeMatcher(true))
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := recordLines(filterTimeRange(records, since, until))
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("filterTimeRange() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTimeBoundResolve(t *testing.T) {
+	first := time.Date(2024, 1, 1, 23, 0, 0, 0, time.UTC)
+	last := time.Date(2024, 1, 2, 1, 0, 0, 0, time.UTC)
+	tests := []struct {
+		bound   string
+		want    time.Time
+		wantErr bool
+	}{
+		{"23:30:00", time.Date(2024, 1, 1, 23, 30, 0, 0, time.UTC), false},
+		{"23:30", time.Date(2024, 1, 1, 23, 30, 0, 0, time.UTC), false},
+		// After midnight, on the day after the first line
+		{"00:30:00", time.Date(2024, 1, 2, 0, 30, 0, 0, time.UTC), false},
+		{"00:30", time.Date(2024, 1, 2, 0, 30, 0, 0, time.UTC), false},
+		{"00:30:15.5", time.Date(2024, 1, 2, 0, 30, 15, 500000000, time.UTC), false},
+		{"23:00", first, false},
+		{"+5m", first.Add(5 * time.Minute), false},
+		{"-5m", last.Add(-5 * time.Minute), false},
+		{"2024-01-01T12:00:00Z", time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC), false},
+		{"25:00", time.Time{}, true},
+		{"10", time.Time{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.bound, func(t *testing.T) {
+			b, err := ParseTimeBound(tt.bound)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseTimeBound() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if got := b.Resolve(first, last); !got.Equal(tt.want) {
+				t.Errorf("Resolve() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
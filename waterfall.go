@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+const waterfallLabelWidth = 24
+
+// WaterfallRow is all events sharing a single correlation ID.
+type WaterfallRow struct {
+	id     string
+	events []time.Time
+}
+
+// Waterfall groups records by correlation ID, to render something resembling a tracing UI.
+type Waterfall struct {
+	matcher *Matcher
+	rows    []*WaterfallRow
+	start   time.Time
+	end     time.Time
+}
+
+// waterfallID returns the correlationID of line, or, as for -delta-key, the whole match if r has no capture groups.
+func waterfallID(r *regexp.Regexp, line string) (string, bool) {
+	if r.NumSubexp() == 0 {
+		loc := r.FindStringIndex(line)
+		if loc == nil {
+			return "", false
+		}
+		return line[loc[0]:loc[1]], true
+	}
+	return correlationID(r, line)
+}
+
+// NewWaterfall groups records by the ID matcher captures (see waterfallID). Rows are ordered by their first event.
+func NewWaterfall(records []LogRecord, matcher *Matcher) *Waterfall {
+	wf := &Waterfall{matcher: matcher}
+	byID := map[string]*WaterfallRow{}
+	for _, r := range records {
+		if r.time == nil {
+			continue
+		}
+		id, f := waterfallID(matcher.r, r.lines[0])
+		if !f {
+			continue
+		}
+		row, f := byID[id]
+		if !f {
+			row = &WaterfallRow{id: id}
+			byID[id] = row
+			wf.rows = append(wf.rows, row)
+		}
+		row.events = append(row.events, r.time.t)
+		if wf.start.IsZero() || r.time.t.Before(wf.start) {
+			wf.start = r.time.t
+		}
+		if r.time.t.After(wf.end) {
+			wf.end = r.time.t
+		}
+	}
+	for _, row := range wf.rows {
+		sort.Slice(row.events, func(i, j int) bool {
+			return row.events[i].Before(row.events[j])
+		})
+	}
+	sort.SliceStable(wf.rows, func(i, j int) bool {
+		return wf.rows[i].events[0].Before(wf.rows[j].events[0])
+	})
+	return wf
+}
+
+// column returns the position of t in a bar of the given width.
+func (wf *Waterfall) column(t time.Time, width int) int {
+	span := wf.end.Sub(wf.start)
+	if span <= 0 {
+		return 0
+	}
+	return min(width-1, int(int64(width)*int64(t.Sub(wf.start))/int64(span)))
+}
+
+// Write renders one row per ID, with a bar spanning its first to last event and a tick for each event.
+func (wf *Waterfall) Write(w io.Writer, loc *time.Location) {
+	if len(wf.rows) == 0 {
+		return
+	}
+	fmt.Fprintf(w, "%-*s %s - %s (%v)\n", waterfallLabelWidth, "", wf.start.In(loc).Format("15:04:05.000"), wf.end.In(loc).Format("15:04:05.000"), wf.end.Sub(wf.start))
+	for _, row := range wf.rows {
+		bar := []rune(strings.Repeat(" ", histogramWidth))
+		first, last := wf.column(row.events[0], histogramWidth), wf.column(row.events[len(row.events)-1], histogramWidth)
+		for c := first; c <= last; c++ {
+			bar[c] = '─'
+		}
+		for _, e := range row.events {
+			bar[wf.column(e, histogramWidth)] = '●'
+		}
+		label := row.id
+		if len(label) > waterfallLabelWidth {
+			label = label[:waterfallLabelWidth-3] + "..."
+		}
+		fmt.Fprintf(w, "%-*s|%s| %v\n",
+			waterfallLabelWidth, label,
+			colorize(wf.matcher.ColorFor(row.id), string(bar)),
+			row.events[len(row.events)-1].Sub(row.events[0]))
+	}
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestNewWaterfall(t *testing.T) {
+	records, err := readRecords(0, strings.NewReader(`2024-01-01T00:00:00.000000Z start push-1
+2024-01-01T00:00:01.000000Z start push-2
+2024-01-01T00:00:02.000000Z end push-1
+2024-01-01T00:00:03.000000Z unrelated
+`), NewTimeMatcher(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name  string
+		regex string
+		want  []string
+	}{
+		{"capture group", `push-(\d+)`, []string{"1", "2"}},
+		{"whole match", `push-\d+`, []string{"push-1", "push-2"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			wf := NewWaterfall(records, NewMatcher(compileRegex(tt.regex), nil))
+			got := []string{}
+			for _, r := range wf.rows {
+				got = append(got, r.id)
+			}
+			if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+				t.Errorf("rows = %v, want %v", got, tt.want)
+			}
+			if n := len(wf.rows[0].events); n != 2 {
+				t.Errorf("got %d events for the first row, want 2", n)
+			}
+		})
+	}
+}